@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminConfig は管理用エンドポイント（/nyan-admin）の設定です。
+type AdminConfig struct {
+	Token string `json:"token"` // Bearer トークン。空なら管理用エンドポイントは無効（環境変数展開可）
+}
+
+// registerAdminRoutes は管理用エンドポイントを登録します。
+func registerAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/nyan-admin", IPFilterMiddleware("admin"), AdminMiddleware())
+	admin.GET("/mcp/sessions", handleAdminListMCPSessions)
+	admin.DELETE("/mcp/sessions/:id", handleAdminDeleteMCPSession)
+}
+
+// AdminMiddleware は管理用トークンを検証します。
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := os.ExpandEnv(globalConfig.Admin.Token)
+		if token == "" {
+			respondWithError(c, http.StatusNotFound, "Endpoint not found", nil)
+			c.Abort()
+			return
+		}
+		authz := c.GetHeader("Authorization")
+		given := ""
+		if len(authz) > 7 && strings.EqualFold(authz[:7], "Bearer ") {
+			given = strings.TrimSpace(authz[7:])
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="nyan-admin"`)
+			respondWithError(c, http.StatusUnauthorized, "Unauthorized", nil)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
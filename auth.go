@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuthConfig は API エンドポイントの認証設定です（config.json の auth）。
+type AuthConfig struct {
+	Default        *APIAuthConfig `json:"default"`        // api.json で auth 未指定の API に適用
+	APIKeyHeader   string         `json:"api_key_header"` // 既定 X-API-Key
+	APIKeyQuery    string         `json:"api_key_query"`  // 空ならクエリでの受け渡しは不可
+	APIKeys        []APIKeyConfig `json:"api_keys"`
+	BasicUsersFile string         `json:"basic_users_file"` // htpasswd 形式（bcrypt）
+	BasicRealm     string         `json:"basic_realm"`
+	JWT            JWTConfig      `json:"jwt"`
+}
+
+// APIAuthConfig は API ごとの認証要件です（api.json の auth）。
+// api.json では true / false の省略形も使えます。
+type APIAuthConfig struct {
+	Required *bool    `json:"required"` // 省略時は true
+	Methods  []string `json:"methods"`  // apikey / basic / jwt / oauth（MCP の OAuth トークン）。空なら全て
+}
+
+// APIKeyConfig は静的 API キーです。key（環境変数展開可）か key_sha256 のどちらかを指定します。
+type APIKeyConfig struct {
+	Name      string   `json:"name"`
+	Key       string   `json:"key,omitempty"`
+	KeySHA256 string   `json:"key_sha256,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+}
+
+// Principal は認証済みの呼び出し元です。JS からは nyanAuth として参照できます。
+type Principal struct {
+	Method  string         `json:"method"` // apikey / basic / jwt / oauth
+	Subject string         `json:"subject"`
+	Roles   []string       `json:"roles"`
+	Scopes  []string       `json:"scopes"`
+	Claims  map[string]any `json:"claims,omitempty"`
+}
+
+// apiGuardError は API 実行前のチェックで拒否した理由です。
+type apiGuardError struct {
+	Status  int
+	Message string
+	Headers map[string]string
+}
+
+func (e *apiGuardError) Error() string {
+	return e.Message
+}
+
+// basicUser は basic_users_file の 1 行です。
+type basicUser struct {
+	Hash  string
+	Roles []string
+}
+
+const (
+	principalKey        = "nyan.principal"
+	defaultAPIKeyHeader = "X-API-Key"
+)
+
+var (
+	basicUsers   map[string]basicUser
+	basicUsersMu sync.RWMutex
+)
+
+// initAuth は Basic 認証ユーザーファイルと JWKS を読み込みます。
+func initAuth(execDir string) error {
+	a := globalConfig.Auth
+	if a.BasicUsersFile != "" {
+		p, err := resolvePath(execDir, a.BasicUsersFile)
+		if err != nil {
+			return fmt.Errorf("invalid auth.basic_users_file: %w", err)
+		}
+		users, err := loadBasicUsers(p)
+		if err != nil {
+			return err
+		}
+		basicUsersMu.Lock()
+		basicUsers = users
+		basicUsersMu.Unlock()
+	}
+	return initJWTKeys(execDir)
+}
+
+// loadBasicUsers は「ユーザー名:bcryptハッシュ[:ロール1,ロール2]」形式のファイルを読み込みます。
+func loadBasicUsers(path string) (map[string]basicUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]basicUser{}
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// bcrypt ハッシュには ':' が含まれないので素直に分割できる
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || !strings.HasPrefix(parts[1], "$2") {
+			return nil, fmt.Errorf("%s:%d: expected user:bcrypt-hash[:roles]", path, lineNo)
+		}
+		u := basicUser{Hash: parts[1]}
+		if len(parts) == 3 {
+			u.Roles = splitList(parts[2])
+		}
+		users[parts[0]] = u
+	}
+	return users, sc.Err()
+}
+
+// apiAuthRequirement は api.json の auth（無ければ config.json の auth.default）を返します。
+// nil の場合は認証不要です。
+func apiAuthRequirement(apiInfo map[string]any) *APIAuthConfig {
+	raw, ok := apiInfo["auth"]
+	if !ok {
+		return globalConfig.Auth.Default
+	}
+	switch v := raw.(type) {
+	case bool:
+		if !v {
+			return nil
+		}
+		return &APIAuthConfig{}
+	case map[string]any:
+		js, _ := json.Marshal(v)
+		var ac APIAuthConfig
+		if err := json.Unmarshal(js, &ac); err != nil {
+			logger.Printf("Invalid auth setting in api.json: %v", err)
+			return &APIAuthConfig{} // 不正な設定は安全側（認証必須）に倒す
+		}
+		return &ac
+	case nil:
+		return globalConfig.Auth.Default
+	}
+	logger.Printf("Invalid auth setting in api.json: %v (expected true, false or an object)", raw)
+	return &APIAuthConfig{} // "jwt" のような書き間違いで認証が外れないよう認証必須にする
+}
+
+func (ac *APIAuthConfig) required() bool {
+	return ac.Required == nil || *ac.Required
+}
+
+func (ac *APIAuthConfig) allows(method string) bool {
+	return len(ac.Methods) == 0 || containsString(ac.Methods, method)
+}
+
+// guardAPICall は API 実行前の共通チェックを行い、拒否する場合はその理由を返します。
+// HTTP / WebSocket / JSON-RPC / MCP の全ての入口から呼び出します。
+// 認証に成功した呼び出し元は gin.Context に保存され、JS の nyanAuth になります。
+func guardAPICall(c *gin.Context, apiName string, apiInfo map[string]any) *apiGuardError {
+	if c == nil {
+		return nil // stdio モードなど、HTTP リクエストを伴わないローカル実行
+	}
+	if !apiIPAllowed(c, apiInfo) {
+		logger.Printf("IPFilter: rejected %s for %s", apiName, getClientIP(c.Request))
+		return &apiGuardError{Status: http.StatusForbidden, Message: "Forbidden"}
+	}
+	if gerr := checkCSRF(c, apiInfo); gerr != nil {
+		logger.Printf("CSRF: rejected %s for %s: %s", apiName, getClientIP(c.Request), gerr.Message)
+		return gerr
+	}
+	p, gerr := authenticateAPIRequest(c, apiInfo)
+	if gerr == nil {
+		gerr = authorizeAPICall(p, apiInfo)
+	}
+	if gerr == nil {
+		gerr = checkRateLimit(c, apiName, apiInfo)
+	}
+	if gerr != nil {
+		logger.Printf("Auth: rejected %s for %s: %s", apiName, getClientIP(c.Request), gerr.Message)
+		return gerr
+	}
+	return nil
+}
+
+// apiAccessRules は api.json の roles / scopes を返します。
+// 文字列（"a,b" / "a b"）と配列のどちらでも書けます。
+func apiAccessRules(apiInfo map[string]any) (roles, scopes []string) {
+	return claimStrings(apiInfo["roles"]), claimStrings(apiInfo["scopes"])
+}
+
+// authorizeAPICall は api.json の roles / scopes を満たすか判定します。
+// roles はいずれか 1 つ、scopes は全てを持っている必要があります。
+func authorizeAPICall(p *Principal, apiInfo map[string]any) *apiGuardError {
+	roles, scopes := apiAccessRules(apiInfo)
+	if len(roles) == 0 && len(scopes) == 0 {
+		return nil
+	}
+	if p == nil {
+		req := apiAuthRequirement(apiInfo)
+		if req == nil {
+			req = &APIAuthConfig{}
+		}
+		return unauthorizedError(req, "Authentication required")
+	}
+	if len(roles) > 0 {
+		ok := false
+		for _, r := range roles {
+			if containsString(p.Roles, r) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return &apiGuardError{Status: http.StatusForbidden, Message: "Insufficient role"}
+		}
+	}
+	for _, s := range scopes {
+		if !containsString(p.Scopes, s) {
+			return &apiGuardError{Status: http.StatusForbidden, Message: fmt.Sprintf("Missing scope %q", s)}
+		}
+	}
+	return nil
+}
+
+// authenticateAPIRequest は API の認証要件に従って呼び出し元を特定します。
+func authenticateAPIRequest(c *gin.Context, apiInfo map[string]any) (*Principal, *apiGuardError) {
+	req := apiAuthRequirement(apiInfo)
+	if roles, scopes := apiAccessRules(apiInfo); req == nil && (len(roles) > 0 || len(scopes) > 0) {
+		req = &APIAuthConfig{} // roles / scopes の指定は認証必須を含意する
+	}
+	if req == nil {
+		// 認証不要でも、MCP の OAuth などで特定済みなら引き継ぐ
+		return principalFromContext(c), nil
+	}
+
+	// MCP の OAuth で認可済みのユーザー（methods で oauth を許可している API のみ）
+	if v, ok := c.Get(mcpOAuthTokenKey); ok {
+		if !req.allows("oauth") {
+			return nil, unauthorizedError(req, "OAuth tokens are not accepted for this API")
+		}
+		tok := v.(*oauthToken)
+		roles := tok.Roles
+		if roles == nil {
+			roles = []string{}
+		}
+		p := &Principal{Method: "oauth", Subject: tok.Subject, Roles: roles, Scopes: tok.Scope}
+		c.Set(principalKey, p)
+		return p, nil
+	}
+
+	// 認証に失敗しすぎた IP は、資格情報を検証する前に拒否する
+	if gerr := checkAuthFailures(c, ""); gerr != nil {
+		return nil, gerr
+	}
+	p, err := identifyCaller(c.Request, req)
+	if err != nil {
+		recordAuthFailure(c, "")
+		return nil, unauthorizedError(req, err.Error())
+	}
+	if p == nil {
+		if req.required() {
+			return nil, unauthorizedError(req, "Authentication required")
+		}
+		return nil, nil
+	}
+	c.Set(principalKey, p)
+	return p, nil
+}
+
+// identifyCaller は許可された方式で資格情報を検証します。
+// 資格情報が無ければ (nil, nil)、不正なら error を返します。
+func identifyCaller(r *http.Request, req *APIAuthConfig) (*Principal, error) {
+	a := globalConfig.Auth
+
+	if req.allows("apikey") {
+		header := a.APIKeyHeader
+		if header == "" {
+			header = defaultAPIKeyHeader
+		}
+		key := r.Header.Get(header)
+		if key == "" && a.APIKeyQuery != "" {
+			key = r.URL.Query().Get(a.APIKeyQuery)
+		}
+		if key != "" {
+			return verifyAPIKey(key)
+		}
+	}
+
+	authz := r.Header.Get("Authorization")
+	scheme, cred, _ := strings.Cut(authz, " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic") && req.allows("basic"):
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			return nil, fmt.Errorf("malformed Basic credentials")
+		}
+		return verifyBasicUser(user, pass)
+	case strings.EqualFold(scheme, "Bearer") && req.allows("jwt"):
+		claims, err := verifyJWT(strings.TrimSpace(cred))
+		if err != nil {
+			return nil, err
+		}
+		return principalFromClaims(claims), nil
+	}
+	return nil, nil
+}
+
+func verifyAPIKey(key string) (*Principal, error) {
+	sum := sha256.Sum256([]byte(key))
+	hashed := hex.EncodeToString(sum[:])
+	for _, k := range globalConfig.Auth.APIKeys {
+		match := false
+		if k.KeySHA256 != "" {
+			match = subtle.ConstantTimeCompare([]byte(strings.ToLower(k.KeySHA256)), []byte(hashed)) == 1
+		} else if expected := os.ExpandEnv(k.Key); expected != "" {
+			match = subtle.ConstantTimeCompare([]byte(expected), []byte(key)) == 1
+		}
+		if match {
+			return &Principal{
+				Method:  "apikey",
+				Subject: k.Name,
+				Roles:   nonNil(k.Roles),
+				Scopes:  nonNil(k.Scopes),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid API key")
+}
+
+func verifyBasicUser(user, pass string) (*Principal, error) {
+	basicUsersMu.RLock()
+	u, ok := basicUsers[user]
+	basicUsersMu.RUnlock()
+	if !ok || !verifyPasswordHash(u.Hash, pass) {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	return &Principal{Method: "basic", Subject: user, Roles: nonNil(u.Roles), Scopes: []string{}}, nil
+}
+
+func unauthorizedError(req *APIAuthConfig, msg string) *apiGuardError {
+	challenges := []string{}
+	if req.allows("basic") && globalConfig.Auth.BasicUsersFile != "" {
+		realm := globalConfig.Auth.BasicRealm
+		if realm == "" {
+			realm = globalConfig.Name
+		}
+		challenges = append(challenges, fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+	}
+	if req.allows("jwt") && jwtConfigured() {
+		challenges = append(challenges, "Bearer")
+	}
+	gerr := &apiGuardError{Status: http.StatusUnauthorized, Message: msg}
+	if len(challenges) > 0 {
+		gerr.Headers = map[string]string{"WWW-Authenticate": strings.Join(challenges, ", ")}
+	}
+	return gerr
+}
+
+// principalFromContext は認証済みの呼び出し元を返します。
+func principalFromContext(c *gin.Context) *Principal {
+	if c == nil {
+		return nil
+	}
+	if v, ok := c.Get(principalKey); ok {
+		return v.(*Principal)
+	}
+	return nil
+}
+
+// respondGuardError は拒否理由を標準のレスポンス形式（ResponseData）で返します。
+func respondGuardError(c *gin.Context, gerr *apiGuardError) {
+	for k, v := range gerr.Headers {
+		c.Header(k, v)
+	}
+	c.AbortWithStatusJSON(gerr.Status, ResponseData{
+		Success: false,
+		Error:   &ErrorData{Code: gerr.Status, Message: gerr.Message},
+	})
+}
+
+// respondJSONRPCGuardError は拒否理由を JSON-RPC のエラーとして返します。
+func respondJSONRPCGuardError(c *gin.Context, id any, gerr *apiGuardError) {
+	for k, v := range gerr.Headers {
+		c.Header(k, v)
+	}
+	respondJSONRPCError(c, id, jsonRPCCodeForStatus(gerr.Status), gerr.Message, nil)
+}
+
+// jsonRPCCodeForStatus は拒否理由の HTTP ステータスを JSON-RPC のエラーコードに変換します。
+func jsonRPCCodeForStatus(status int) int {
+	switch status {
+	case http.StatusUnauthorized:
+		return -32001
+	case http.StatusForbidden:
+		return -32003
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return -32029
+	case http.StatusNotFound:
+		return -32601
+	}
+	return -32603
+}
+
+// principalJSValue は nyanAuth に渡す値を作ります（未認証なら nil）。
+func principalJSValue(p *Principal) map[string]any {
+	if p == nil {
+		return nil
+	}
+	claims := p.Claims
+	if claims == nil {
+		claims = map[string]any{}
+	}
+	return map[string]any{
+		"method":  p.Method,
+		"subject": p.Subject,
+		"roles":   p.Roles,
+		"scopes":  p.Scopes,
+		"claims":  claims,
+	}
+}
+
+func splitList(s string) []string {
+	out := []string{}
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// SandboxConfig はスクリプトに許可する機能の既定値です（config.json の sandbox）。
+type SandboxConfig struct {
+	DefaultAllow []string `json:"default_allow"` // api.json で allow 未指定のスクリプトに適用。未設定なら制限なし
+	Audit        *bool    `json:"audit"`         // 機能の利用をログに記録する（既定 true）
+}
+
+// スクリプトに許可できる機能
+//
+//	http[:URL]         nyanGetAPI / nyanJsonAPI（スキームとホストが一致し、パスがその下にある URL）
+//	mail               nyanSendMail
+//	fs:read[:パス]     nyanGetFile / nyanReadFileB64 / nyanSendMailAttachment / 添付の path
+//	exec[:コマンド]     nyanHostExec / nyanSpawn / nyanGetProcess
+//	db[:接続名]         nyanDB
+var capabilityKinds = map[string]bool{
+	"http":    true,
+	"mail":    true,
+	"fs:read": true,
+	"exec":    true,
+	"db":      true,
+}
+
+// capabilitySet は 1 回のスクリプト実行に許可された機能です。
+// grants が nil（allow も sandbox.default_allow も無い場合）なら制限しません。
+type capabilitySet struct {
+	api    string
+	grants map[string][]string // 種類 -> 対象（"" は対象を限定しない）
+}
+
+// apiCapabilities は api.json の allow（無ければ sandbox.default_allow）から許可する機能を作ります。
+func apiCapabilities(apiName string, apiInfo map[string]any) *capabilitySet {
+	raw, ok := apiInfo["allow"]
+	if !ok {
+		return newCapabilitySet(apiName, globalConfig.Sandbox.DefaultAllow)
+	}
+	return newCapabilitySet(apiName, claimStrings(raw))
+}
+
+// newCapabilitySet は "http" / "fs:read:./data" / "exec:/usr/bin/convert" 形式の一覧を解析します。
+func newCapabilitySet(apiName string, allow []string) *capabilitySet {
+	if allow == nil {
+		return &capabilitySet{api: apiName}
+	}
+	cs := &capabilitySet{api: apiName, grants: map[string][]string{}}
+	for _, a := range allow {
+		kind, target := splitCapability(strings.TrimSpace(a))
+		if !capabilityKinds[kind] {
+			logger.Printf("Sandbox: unknown capability %q in %s", a, apiName)
+			continue
+		}
+		cs.grants[kind] = append(cs.grants[kind], target)
+	}
+	return cs
+}
+
+// splitCapability は "fs:read:./data" を ("fs:read", "./data") に分けます。
+func splitCapability(s string) (kind, target string) {
+	if strings.HasPrefix(s, "fs:") {
+		rest := strings.TrimPrefix(s, "fs:")
+		op, target, _ := strings.Cut(rest, ":")
+		return "fs:" + op, target
+	}
+	kind, target, _ = strings.Cut(s, ":")
+	return kind, target
+}
+
+// has は機能の種類が許可されているかを返します。
+func (cs *capabilitySet) has(kind string) bool {
+	if cs == nil || cs.grants == nil {
+		return true
+	}
+	_, ok := cs.grants[kind]
+	return ok
+}
+
+// allows は対象（URL・パス・コマンド）を含めて許可されているかを返します。
+func (cs *capabilitySet) allows(kind, target string) bool {
+	if cs == nil || cs.grants == nil {
+		return true
+	}
+	for _, g := range cs.grants[kind] {
+		if g == "" {
+			return true
+		}
+		switch kind {
+		case "http":
+			if httpTargetWithin(g, target) {
+				return true
+			}
+		case "fs:read":
+			// スクリプトと同じくファイルルートの中で解決する
+			dir := filepath.Clean(g)
+			if !filepath.IsAbs(g) {
+				var err error
+				if dir, err = resolveScriptPath(g); err != nil {
+					continue
+				}
+			}
+			if pathWithin(dir, target) {
+				return true
+			}
+		case "exec", "db":
+			if target == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpTargetWithin は URL が http:<URL> の許可の範囲内かを返します。
+// スキームとホスト（ポートを含む）は完全に一致し、パスは "/" の区切りで許可したパスの下にある必要があります。
+func httpTargetWithin(grant, target string) bool {
+	g, err := url.Parse(grant)
+	if err != nil || g.Scheme == "" || g.Host == "" {
+		return false
+	}
+	t, err := url.Parse(target)
+	if err != nil || t.Host == "" {
+		return false
+	}
+	if !strings.EqualFold(g.Scheme, t.Scheme) || urlHostPort(g) != urlHostPort(t) {
+		return false
+	}
+	prefix := strings.TrimSuffix(g.Path, "/")
+	if prefix == "" {
+		return true
+	}
+	// "/v1/../admin" のような相対指定で許可したパスの外に出られないよう正規化して比べる
+	p := path.Clean("/" + t.Path)
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// urlHostPort は URL のホストを小文字にし、省略されたポートをスキームの既定値で補って返します。
+func urlHostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "https":
+			port = "443"
+		case "http":
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// httpClient は http の許可をリダイレクト先にも適用する HTTP クライアントを返します。
+func (cs *capabilitySet) httpClient(sr *scriptRequest) *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			target := req.URL.String()
+			if !cs.allows("http", target) {
+				auditCapability(sr, "http", target, false)
+				return fmt.Errorf("PermissionError: redirect to %q is not allowed for %s", target, cs.api)
+			}
+			return nil
+		},
+	}
+}
+
+// require は機能が許可されていなければ JS の例外を投げ、許可されていれば監査ログに記録します。
+func (cs *capabilitySet) require(vm *goja.Runtime, sr *scriptRequest, kind, target string) {
+	if !cs.allows(kind, target) {
+		auditCapability(sr, kind, target, false)
+		panic(vm.NewGoError(fmt.Errorf("PermissionError: %q is not allowed for %s (add it to \"allow\" in api.json)", kind+":"+target, cs.api)))
+	}
+	auditCapability(sr, kind, target, true)
+}
+
+// deniedBinding は許可されていない nyan 関数の代わりに置く関数です。
+func deniedBinding(vm *goja.Runtime, sr *scriptRequest, name, kind string) func(goja.FunctionCall) goja.Value {
+	return func(goja.FunctionCall) goja.Value {
+		auditCapability(sr, kind, name, false)
+		panic(vm.NewGoError(fmt.Errorf("PermissionError: %s requires capability %q (add it to \"allow\" in api.json)", name, kind)))
+	}
+}
+
+// setCapabilityBinding は機能が許可されている場合だけ fn を登録し、そうでなければ拒否する関数を登録します。
+func setCapabilityBinding(vm *goja.Runtime, sr *scriptRequest, kind, name string, fn any) {
+	if sr.Caps.has(kind) {
+		vm.Set(name, fn)
+		return
+	}
+	vm.Set(name, deniedBinding(vm, sr, name, kind))
+}
+
+// auditCapability は機能の利用（または拒否）をログに記録します。
+func auditCapability(sr *scriptRequest, kind, target string, allowed bool) {
+	if a := globalConfig.Sandbox.Audit; a != nil && !*a && allowed {
+		return
+	}
+	result := "allowed"
+	if !allowed {
+		result = "denied"
+	}
+	api := ""
+	if sr.Caps != nil {
+		api = sr.Caps.api
+	}
+	who := "-"
+	if sr.Principal != nil {
+		who = sr.Principal.Method + ":" + sr.Principal.Subject
+	}
+	ip := "-"
+	if sr.Request != nil {
+		ip = getClientIP(sr.Request)
+	}
+	logger.Printf("Audit: capability %s %s:%s api=%s principal=%s ip=%s", result, kind, target, api, who, ip)
+}
+
+// execProgram は exec:<コマンド> と照合するためのプログラム名を返します。
+// シェルの構文を含むコマンドは丸ごと返し、対象を限定しない exec だけで許可されるようにします。
+func execProgram(cmd string) string {
+	if strings.ContainsAny(cmd, ";&|<>`$(){}*?[]~!\n\"'\\") {
+		return cmd
+	}
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// pathWithin は path が dir 以下にあるかを返します。
+func pathWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPTargetWithin(t *testing.T) {
+	cases := []struct {
+		grant, target string
+		want          bool
+	}{
+		{"https://api.example.com", "https://api.example.com/v1/users", true},
+		{"https://api.example.com/", "https://API.example.com:443/", true},
+		{"https://api.example.com", "https://api.example.com.evil.net/", false},
+		{"https://api.example.com", "https://api.example.com@evil.com/", false},
+		{"https://api.example.com", "http://api.example.com/", false},
+		{"https://api.example.com", "https://api.example.com:8443/", false},
+		{"https://api.example.com/v1", "https://api.example.com/v1", true},
+		{"https://api.example.com/v1/", "https://api.example.com/v1/users?id=1", true},
+		{"https://api.example.com/v1", "https://api.example.com/v10", false},
+		{"https://api.example.com/v1", "https://api.example.com/v1/../admin", false},
+		{"https://api.example.com/v1", "https://api.example.com/v1/%2e%2e/admin", false},
+		{"api.example.com", "https://api.example.com/", false},
+		{"https://api.example.com", "/relative", false},
+	}
+	for _, tc := range cases {
+		if got := httpTargetWithin(tc.grant, tc.target); got != tc.want {
+			t.Errorf("httpTargetWithin(%q, %q) = %v, want %v", tc.grant, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPClientChecksRedirects(t *testing.T) {
+	saved := logger
+	logger = log.New(testWriter{t}, "", 0)
+	t.Cleanup(func() { logger = saved })
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/away":
+			http.Redirect(w, r, other.URL+"/", http.StatusFound)
+		case "/inside":
+			http.Redirect(w, r, "/ok", http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	cs := newCapabilitySet("t", []string{"http:" + srv.URL})
+	client := cs.httpClient(&scriptRequest{Caps: cs})
+
+	body, err := getAPI(client, srv.URL+"/inside", "", "")
+	if err != nil || body != "ok" {
+		t.Fatalf("redirect within the grant: %q, %v", body, err)
+	}
+	if _, err := getAPI(client, srv.URL+"/away", "", ""); err == nil || !strings.Contains(err.Error(), "PermissionError") {
+		t.Fatalf("redirect to another host: got %v, want PermissionError", err)
+	}
+}
+
+// testWriter はログをテストの出力に流します。
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// 有効期間を指定しない nyanSetCookie の既定（従来どおり 1 時間）
+const defaultCookieMaxAge = 3600
+
+// cookieOptions は nyanSetCookie / nyanDeleteCookie の第 3 引数です。
+// 数値だけを渡した場合は maxAge（秒）として扱います。
+func cookieOptions(r *http.Request, ck *http.Cookie, v goja.Value) error {
+	ck.Path = "/"
+	ck.HttpOnly = true
+	ck.SameSite = http.SameSiteLaxMode
+	ck.Secure = r != nil && r.TLS != nil
+	ck.MaxAge = defaultCookieMaxAge
+	if isNullish(v) {
+		return nil
+	}
+	opts, ok := v.Export().(map[string]any)
+	if !ok {
+		n, ok := toInt(v.Export())
+		if !ok {
+			return fmt.Errorf("options must be a number (maxAge) or an object")
+		}
+		ck.MaxAge = n
+		return nil
+	}
+	for k, raw := range opts {
+		switch k {
+		case "maxAge":
+			n, ok := toInt(raw)
+			if !ok {
+				return fmt.Errorf("maxAge must be a number of seconds")
+			}
+			ck.MaxAge = n
+		case "expires":
+			t, err := cookieExpires(raw)
+			if err != nil {
+				return err
+			}
+			ck.Expires = t
+			if _, ok := opts["maxAge"]; !ok {
+				ck.MaxAge = 0 // expires だけを指定した場合は Max-Age を付けない
+			}
+		case "path":
+			ck.Path = fmt.Sprint(raw)
+		case "domain":
+			ck.Domain = fmt.Sprint(raw)
+		case "secure":
+			ck.Secure, _ = raw.(bool)
+		case "httpOnly":
+			ck.HttpOnly, _ = raw.(bool)
+		case "sameSite":
+			s := strings.ToLower(fmt.Sprint(raw))
+			if s != "lax" && s != "strict" && s != "none" {
+				return fmt.Errorf("sameSite must be lax, strict or none")
+			}
+			ck.SameSite = parseSameSite(s)
+		default:
+			return fmt.Errorf("unknown cookie option %q", k)
+		}
+	}
+	if ck.SameSite == http.SameSiteNoneMode {
+		// SameSite=None はブラウザが Secure を必須にしている
+		ck.Secure = true
+	}
+	return nil
+}
+
+// cookieExpires は Date・UNIX ミリ秒・日時の文字列を time.Time にします。
+func cookieExpires(raw any) (time.Time, error) {
+	switch t := raw.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		if tm, err := time.Parse(time.RFC3339, t); err == nil {
+			return tm, nil
+		}
+		if tm, err := http.ParseTime(t); err == nil {
+			return tm, nil
+		}
+		return time.Time{}, fmt.Errorf("invalid expires %q", t)
+	}
+	if ms, ok := toInt(raw); ok {
+		return time.UnixMilli(int64(ms)), nil
+	}
+	return time.Time{}, fmt.Errorf("expires must be a Date, a timestamp or a date string")
+}
+
+// setResponseCookie は Set-Cookie を追加します。
+// 同じ実行の中で同じ名前・パス・ドメインの Cookie を何度設定しても、最後の 1 つだけを送ります。
+func setResponseCookie(w http.ResponseWriter, ck *http.Cookie) {
+	h := w.Header()
+	values := h.Values("Set-Cookie")
+	kept := make([]string, 0, len(values))
+	for _, v := range values {
+		old, err := http.ParseSetCookie(v)
+		if err == nil && old.Name == ck.Name && old.Path == ck.Path && old.Domain == strings.TrimPrefix(ck.Domain, ".") {
+			continue
+		}
+		kept = append(kept, v)
+	}
+	h.Del("Set-Cookie")
+	for _, v := range kept {
+		h.Add("Set-Cookie", v)
+	}
+	http.SetCookie(w, ck)
+}
+
+// requestCookies は名前 -> 値の一覧を返します（同じ名前が複数あれば最初のもの）。
+func requestCookies(r *http.Request) map[string]string {
+	out := map[string]string{}
+	if r == nil {
+		return out
+	}
+	for _, ck := range r.Cookies() {
+		if _, ok := out[ck.Name]; ok {
+			continue
+		}
+		v, err := url.QueryUnescape(ck.Value)
+		if err != nil {
+			v = ck.Value
+		}
+		out[ck.Name] = v
+	}
+	return out
+}
+
+// setupCookieBindings は nyanGetCookie / nyanGetCookies / nyanSetCookie / nyanDeleteCookie を登録します。
+// 読み取りは WebSocket のメッセージ処理でも接続時（アップグレード要求）の Cookie を参照します。
+// WebSocket のメッセージ処理には Set-Cookie を載せる応答が無く（アップグレードの応答は送信済み）、設定・削除は例外になります。
+func setupCookieBindings(vm *goja.Runtime, sr *scriptRequest) {
+	vm.Set("nyanGetCookie", func(name string) string {
+		return requestCookies(sr.Request)[name]
+	})
+	vm.Set("nyanGetCookies", func() map[string]string {
+		return requestCookies(sr.Request)
+	})
+
+	write := func(fn string, ck *http.Cookie, opts goja.Value) bool {
+		if err := cookieOptions(sr.Request, ck, opts); err != nil {
+			panic(vm.NewGoError(fmt.Errorf("%s: %w", fn, err)))
+		}
+		if fn == "nyanDeleteCookie" {
+			// 設定時と同じ path / domain で期限切れの Cookie を送る
+			ck.MaxAge, ck.Expires = -1, time.Time{}
+		}
+		if err := ck.Valid(); err != nil {
+			panic(vm.NewGoError(fmt.Errorf("%s: %w", fn, err)))
+		}
+		if sr.Gin == nil {
+			panic(vm.NewGoError(fmt.Errorf("%s: cannot set cookies here (WebSocket messages have no HTTP response; set them from an HTTP API before connecting)", fn)))
+		}
+		setResponseCookie(sr.Gin.Writer, ck)
+		return true
+	}
+	vm.Set("nyanSetCookie", func(name, value string, opts goja.Value) bool {
+		// gin の SetCookie と同じく値は URL エンコードする（nyanGetCookie で元に戻る）
+		return write("nyanSetCookie", &http.Cookie{Name: name, Value: url.QueryEscape(value)}, opts)
+	})
+	vm.Set("nyanDeleteCookie", func(name string, opts goja.Value) bool {
+		return write("nyanDeleteCookie", &http.Cookie{Name: name}, opts)
+	})
+}
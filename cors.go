@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig は CORS の設定です（config.json の cors、api.json の cors で API ごとに上書き可能）。
+type CORSConfig struct {
+	AllowOrigins     []string `json:"allow_origins"`     // 完全一致、"https://*.example.com" のようなパターン、または "*"
+	AllowMethods     []string `json:"allow_methods"`     // 空なら GET, POST, PUT, DELETE, OPTIONS
+	AllowHeaders     []string `json:"allow_headers"`     // 空なら既定のヘッダー
+	ExposeHeaders    []string `json:"expose_headers"`    // 空なら Mcp-Session-Id / RateLimit-* など
+	MaxAge           int      `json:"max_age"`           // プリフライト結果のキャッシュ秒数。0 なら送らない
+	AllowCredentials bool     `json:"allow_credentials"` // "*" で許可したオリジンには付与しない
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{
+		"Origin", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization",
+		"X-API-Key", "Mcp-Session-Id", "MCP-Protocol-Version",
+	}
+	defaultCORSExposeHeaders = []string{
+		"Mcp-Session-Id", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After",
+	}
+)
+
+// CORSMiddleware は設定に従って CORS ヘッダーを付与し、プリフライトに応答します。
+func CORSMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin != "" {
+			if policy := corsPolicyForRequest(c.Request); policy != nil {
+				applyCORSHeaders(c, policy, origin)
+			}
+		}
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+		c.Next()
+	}
+}
+
+// applyCORSHeaders はオリジンが許可されていれば CORS ヘッダーを設定します。
+func applyCORSHeaders(c *gin.Context, policy *CORSConfig, origin string) {
+	h := c.Writer.Header()
+	allowed, wildcard := policy.matchOrigin(origin)
+	if origins := policy.allowOrigins(); len(origins) != 1 || origins[0] != "*" {
+		// オリジンごとに応答が変わるのでキャッシュに知らせる
+		h.Add("Vary", "Origin")
+	}
+	if !allowed {
+		return
+	}
+
+	if wildcard {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if policy.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != "" {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(orDefault(policy.AllowMethods, defaultCORSMethods), ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(orDefault(policy.AllowHeaders, defaultCORSHeaders), ", "))
+		if policy.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+		}
+		return
+	}
+	if expose := orDefault(policy.ExposeHeaders, defaultCORSExposeHeaders); len(expose) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+	}
+}
+
+// matchOrigin はオリジンが許可されているかと、"*" による許可かどうかを返します。
+// 完全一致とパターンは "*" より優先されます（資格情報付きで応答できるように）。
+func (p *CORSConfig) matchOrigin(origin string) (allowed, wildcard bool) {
+	o := strings.ToLower(origin)
+	star := false
+	for _, pat := range p.allowOrigins() {
+		pat = strings.ToLower(pat)
+		if pat == "*" {
+			star = true
+			continue
+		}
+		if pat == o {
+			return true, false
+		}
+		if strings.Contains(pat, "*") {
+			if ok, _ := path.Match(pat, o); ok {
+				return true, false
+			}
+		}
+	}
+	return star, star
+}
+
+// allowOrigins は許可オリジンの一覧を返します。
+// 未設定の場合は従来どおり全オリジンを許可します（資格情報は付与しない）。
+func (p *CORSConfig) allowOrigins() []string {
+	if p.AllowOrigins == nil {
+		return []string{"*"}
+	}
+	return p.AllowOrigins
+}
+
+// corsPolicyForRequest はリクエスト先 API の CORS 設定を返します（nil なら CORS ヘッダーを付けない）。
+func corsPolicyForRequest(r *http.Request) *CORSConfig {
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" {
+		name = r.URL.Query().Get("api")
+	}
+	if name == "" || strings.Contains(name, "/") {
+		policy := globalConfig.CORS
+		return &policy
+	}
+	apiConf, err := loadJSONFile(filepath.Join(getBaseDir(), "api.json"))
+	if err != nil {
+		policy := globalConfig.CORS
+		return &policy
+	}
+	apiInfo, _ := apiConf[name].(map[string]any)
+	return apiCORSPolicy(apiInfo)
+}
+
+// apiCORSPolicy は config.json の cors に api.json の cors を重ねた設定を返します。
+// "cors": false の API には CORS ヘッダーを付けません。
+func apiCORSPolicy(apiInfo map[string]any) *CORSConfig {
+	policy := globalConfig.CORS
+	switch v := apiInfo["cors"].(type) {
+	case bool:
+		if !v {
+			return nil
+		}
+	case map[string]any:
+		js, _ := json.Marshal(v)
+		if err := json.Unmarshal(js, &policy); err != nil {
+			logger.Printf("Invalid cors setting in api.json: %v", err)
+		}
+	}
+	return &policy
+}
+
+// checkWebSocketOrigin は WebSocket 接続のオリジンを CORS 設定で検証します。
+// Origin ヘッダーの無いクライアント（ブラウザ以外）と同一オリジンは常に許可します。
+// WebSocket は CORS の対象外でブラウザが Cookie を付けて接続するため、"*" による許可は使わず、
+// allow_origins に明示したオリジン（パターンを含む）だけを許可します。
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	policy := corsPolicyForRequest(r)
+	if policy == nil {
+		return false
+	}
+	allowed, wildcard := policy.matchOrigin(origin)
+	allowed = allowed && !wildcard
+	if !allowed {
+		logger.Printf("WebSocket: rejected origin %s for %s", origin, r.URL.Path)
+	}
+	return allowed
+}
+
+func orDefault(v, def []string) []string {
+	if v == nil {
+		return def
+	}
+	return v
+}
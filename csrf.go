@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/gin-gonic/gin"
+)
+
+// CSRFConfig は CSRF 対策の共通設定です（config.json の csrf）。
+// 検証するかどうかは api.json の csrf で API ごとに指定します。
+type CSRFConfig struct {
+	Mode           string   `json:"mode"`            // double_submit（既定）/ synchronizer
+	CookieName     string   `json:"cookie_name"`     // double_submit のトークン Cookie。既定 nyan8_csrf
+	HeaderName     string   `json:"header_name"`     // 既定 X-CSRF-Token
+	FieldName      string   `json:"field_name"`      // フォームの項目名。既定 _csrf
+	TrustedOrigins []string `json:"trusted_origins"` // 同一オリジン以外に許可するオリジン（"https://*.example.com" のようなパターン可）
+}
+
+// APICSRF は API ごとの CSRF 対策です（api.json の csrf）。
+type APICSRF struct {
+	Token          *bool    `json:"token"`           // トークンを検証するか。既定 true（false なら Origin / Referer のみ）
+	TrustedOrigins []string `json:"trusted_origins"` // config.json の trusted_origins に追加で許可するオリジン
+}
+
+// synchronizer モードでトークンを保存するセッションのキー
+const csrfSessionKey = "_csrf"
+
+func csrfMode() string {
+	if globalConfig.CSRF.Mode == "synchronizer" {
+		return "synchronizer"
+	}
+	return "double_submit"
+}
+
+func csrfCookieName() string {
+	if n := globalConfig.CSRF.CookieName; n != "" {
+		return n
+	}
+	return "nyan8_csrf"
+}
+
+func csrfHeaderName() string {
+	if n := globalConfig.CSRF.HeaderName; n != "" {
+		return n
+	}
+	return "X-CSRF-Token"
+}
+
+func csrfFieldName() string {
+	if n := globalConfig.CSRF.FieldName; n != "" {
+		return n
+	}
+	return "_csrf"
+}
+
+// apiCSRF は api.json の csrf を返します（無効なら nil）。
+// "csrf": true でトークンと Origin / Referer の両方を検証します。
+func apiCSRF(apiInfo map[string]any) *APICSRF {
+	switch v := apiInfo["csrf"].(type) {
+	case bool:
+		if v {
+			return &APICSRF{}
+		}
+	case map[string]any:
+		js, _ := json.Marshal(v)
+		var ac APICSRF
+		if err := json.Unmarshal(js, &ac); err != nil {
+			logger.Printf("Invalid csrf setting in api.json: %v", err)
+			return &APICSRF{} // 設定の誤りで保護が外れないよう既定で検証する
+		}
+		return &ac
+	}
+	return nil
+}
+
+// checkCSRF は状態を変更するメソッド（GET / HEAD / OPTIONS 以外）の CSRF を検証します。
+// WebSocket のメッセージはアップグレード時の GET で判定されるため対象外です（オリジンは接続時に検証済み）。
+func checkCSRF(c *gin.Context, apiInfo map[string]any) *apiGuardError {
+	ac := apiCSRF(apiInfo)
+	if ac == nil {
+		return nil
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	if !csrfOriginAllowed(c.Request, ac) {
+		return &apiGuardError{Status: http.StatusForbidden, Message: "Cross-site request rejected"}
+	}
+	if ac.Token != nil && !*ac.Token {
+		return nil
+	}
+	if !csrfTokenValid(c.Request) {
+		return &apiGuardError{Status: http.StatusForbidden, Message: "Invalid CSRF token"}
+	}
+	return nil
+}
+
+// csrfOriginAllowed は Origin（無ければ Referer）が同一オリジンか許可したオリジンかを判定します。
+// どちらも無いリクエスト（ブラウザ以外のクライアント）はトークンの検証に任せます。
+func csrfOriginAllowed(r *http.Request, ac *APICSRF) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		ref := r.Header.Get("Referer")
+		if ref == "" {
+			return true
+		}
+		u, err := url.Parse(ref)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	if origin == "null" {
+		// サンドボックス化された iframe や file:// からの送信
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	o := strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, list := range [][]string{globalConfig.CSRF.TrustedOrigins, ac.TrustedOrigins} {
+		for _, pat := range list {
+			pat = strings.ToLower(pat)
+			if pat == o {
+				return true
+			}
+			if ok, _ := path.Match(pat, o); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// submittedCSRFToken はヘッダー、無ければフォームの項目からトークンを取り出します。
+func submittedCSRFToken(r *http.Request) string {
+	if t := r.Header.Get(csrfHeaderName()); t != "" {
+		return t
+	}
+	// フォーム以外（JSON など）の本文は読まないため、その場合はヘッダーで送る
+	return r.PostFormValue(csrfFieldName())
+}
+
+// csrfTokenValid は送られたトークンを、double_submit なら Cookie、synchronizer ならセッションと照合します。
+func csrfTokenValid(r *http.Request) bool {
+	sent := submittedCSRFToken(r)
+	if sent == "" {
+		return false
+	}
+	var expected string
+	if csrfMode() == "synchronizer" {
+		expected = sessionCSRFToken(r)
+	} else if ck, err := r.Cookie(csrfCookieName()); err == nil && verifyCSRFCookie(ck.Value, webSessionIDFromRequest(r)) {
+		expected = ck.Value
+	}
+	return expected != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) == 1
+}
+
+// signCSRFToken は double_submit の "乱数.署名" 形式のトークンを作ります。
+// 署名にはセッション ID（無ければ空）を含めます。セッション ID は HttpOnly の Cookie で他者に読めないため、
+// サブドメインなどから Cookie を書き込まれても、そのブラウザのセッションで通るトークンは作れません。
+func signCSRFToken(nonce, sessionID string) string {
+	mac := hmac.New(sha256.New, webSessionKey)
+	mac.Write([]byte("csrf\x00" + sessionID + "\x00" + nonce))
+	return nonce + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCSRFCookie はトークンが sessionID に対して発行されたものかを検証します。
+func verifyCSRFCookie(value, sessionID string) bool {
+	nonce, _, ok := strings.Cut(value, ".")
+	return ok && nonce != "" && subtle.ConstantTimeCompare([]byte(signCSRFToken(nonce, sessionID)), []byte(value)) == 1
+}
+
+// sessionCSRFToken はリクエストのセッションに保存されたトークンを返します（無ければ空）。
+func sessionCSRFToken(r *http.Request) string {
+	id := webSessionIDFromRequest(r)
+	if id == "" {
+		return ""
+	}
+	e, err := storage.get(webSessionStore.key(id))
+	if err != nil || e == nil {
+		return ""
+	}
+	data := map[string]any{}
+	if err := json.Unmarshal(e.Value, &data); err != nil {
+		return ""
+	}
+	t, _ := data[csrfSessionKey].(string)
+	return t
+}
+
+// setupCSRFBindings は nyanCsrfToken を登録します。
+// トークンが無ければ作り、double_submit では Cookie、synchronizer ではセッションに保存します。
+func setupCSRFBindings(vm *goja.Runtime, sr *scriptRequest, s *webSession) {
+	// double_submit で同じ実行の中では同じ Cookie を使う（セッション ID が変わったら作り直す）
+	var token, tokenSession string
+	vm.Set("nyanCsrfToken", func() string {
+		if csrfMode() == "synchronizer" {
+			if data := s.load(); data != nil {
+				if t, _ := data[csrfSessionKey].(string); t != "" {
+					return t
+				}
+			}
+			t := generateSecureSessionID()
+			s.modify(func(data map[string]any) { data[csrfSessionKey] = t })
+			return t
+		}
+		if token != "" && tokenSession == s.id {
+			return token
+		}
+		if sr.Request != nil {
+			if ck, err := sr.Request.Cookie(csrfCookieName()); err == nil && verifyCSRFCookie(ck.Value, s.id) {
+				token, tokenSession = ck.Value, s.id
+				return token
+			}
+		}
+		if sr.Gin == nil {
+			panic(vm.NewGoError(fmt.Errorf("nyanCsrfToken: cannot set the CSRF cookie here (WebSocket messages can only use an existing token)")))
+		}
+		t := signCSRFToken(generateSecureSessionID(), s.id)
+		// フロントエンドの JavaScript がヘッダーに載せられるよう HttpOnly にはしない
+		setResponseCookie(sr.Gin.Writer, &http.Cookie{
+			Name:     csrfCookieName(),
+			Value:    t,
+			Path:     "/",
+			SameSite: http.SameSiteLaxMode,
+			Secure:   sr.Request != nil && sr.Request.TLS != nil,
+		})
+		token, tokenSession = t, s.id
+		return token
+	})
+}
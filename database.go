@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// DatabaseConfig はスクリプトから使うデータベースの接続です（config.json の databases）。
+type DatabaseConfig struct {
+	Driver             string `json:"driver"`               // sqlite（既定）/ postgres / mysql
+	DSN                string `json:"dsn"`                  // 接続文字列（環境変数展開可）。sqlite ならファイルのパス
+	MaxOpenConns       int    `json:"max_open_conns"`       // 同時に開く接続の上限。0 なら無制限
+	MaxIdleConns       int    `json:"max_idle_conns"`       // 待機させておく接続の数。0 なら 2
+	ConnMaxLifetime    int    `json:"conn_max_lifetime"`    // 接続を使い回す上限（秒）。0 なら無制限
+	ConnMaxIdleTime    int    `json:"conn_max_idle_time"`   // 待機中の接続を閉じるまで（秒）。0 なら無制限
+	StatementTimeoutMs int    `json:"statement_timeout_ms"` // 1 つの query / exec の上限。0 なら無制限
+}
+
+// sqlDatabase は名前付きの接続プールです。
+type sqlDatabase struct {
+	db               *sql.DB
+	driver           string // database/sql のドライバー名（sqlite / pgx / mysql）
+	statementTimeout time.Duration
+}
+
+// 名前 -> 接続プール
+var databases = map[string]*sqlDatabase{}
+
+// sqlDriverNames は config.json の driver を database/sql のドライバー名に対応付けます。
+var sqlDriverNames = map[string]string{
+	"sqlite":     "sqlite",
+	"postgres":   "pgx",
+	"postgresql": "pgx",
+	"mysql":      "mysql",
+}
+
+// initDatabases は config.json の databases の接続を開きます。
+func initDatabases(execDir string) error {
+	for name, dc := range globalConfig.Databases {
+		db, driverName, err := openDatabase(execDir, dc)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+		databases[name] = &sqlDatabase{
+			db:               db,
+			driver:           driverName,
+			statementTimeout: time.Duration(dc.StatementTimeoutMs) * time.Millisecond,
+		}
+	}
+	return nil
+}
+
+func openDatabase(execDir string, dc DatabaseConfig) (*sql.DB, string, error) {
+	driver := dc.Driver
+	if driver == "" {
+		driver = "sqlite"
+	}
+	driverName, ok := sqlDriverNames[driver]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown driver %q", dc.Driver)
+	}
+	// パスワードなどを config.json に書かずに済むよう環境変数を展開する（sqlite は resolvePath で展開）
+	dsn := dc.DSN
+	if driver == "sqlite" {
+		var err error
+		if dsn, err = sqliteDSN(execDir, dsn); err != nil {
+			return nil, "", err
+		}
+	} else {
+		dsn = os.ExpandEnv(dsn)
+		if dsn == "" {
+			return nil, "", fmt.Errorf("dsn is required")
+		}
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, "", err
+	}
+	db.SetMaxOpenConns(dc.MaxOpenConns)
+	if dc.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(dc.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(time.Duration(dc.ConnMaxLifetime) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(dc.ConnMaxIdleTime) * time.Second)
+	if dsn == ":memory:" {
+		// :memory: は接続ごとに別のデータベースになるので 1 本に限る
+		db.SetMaxOpenConns(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		if driver == "sqlite" {
+			db.Close()
+			return nil, "", err
+		}
+		// サーバーが後から起動しても使えるよう、外部のデータベースは警告だけにする（接続はクエリ時に再試行される）
+		logger.Printf("Database: cannot connect to %s yet: %v", driver, err)
+	}
+	return db, driverName, nil
+}
+
+// sqliteDSN はファイルのパスを実行ディレクトリ基準で解決し、既定の pragma を付けます。
+func sqliteDSN(execDir, dsn string) (string, error) {
+	if dsn == "" {
+		return "", fmt.Errorf("dsn is required")
+	}
+	if dsn == ":memory:" || strings.HasPrefix(dsn, "file:") {
+		return dsn, nil
+	}
+	path, query, _ := strings.Cut(dsn, "?")
+	path, err := resolvePath(execDir, path)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(query, "foreign_keys") {
+		query = joinQuery(query, "_pragma=foreign_keys(1)")
+	}
+	// 書き込み中も読み取れるよう WAL にし、書き込みのロックは最大 5 秒待つ
+	if !strings.Contains(query, "journal_mode") {
+		query = joinQuery(query, "_pragma=journal_mode(WAL)")
+	}
+	if !strings.Contains(query, "busy_timeout") {
+		query = joinQuery(query, "_pragma=busy_timeout(5000)")
+	}
+	return path + "?" + query, nil
+}
+
+func joinQuery(q, param string) string {
+	if q == "" {
+		return param
+	}
+	return q + "&" + param
+}
+
+// lookupDatabase は名前の接続を返します。接続が 1 つだけなら名前は省略できます。
+func lookupDatabase(name string) (string, *sqlDatabase, error) {
+	if name == "" && len(databases) == 1 {
+		for n := range databases {
+			name = n
+		}
+	}
+	db, ok := databases[name]
+	if !ok {
+		return name, nil, fmt.Errorf("unknown database %q (configure databases in config.json)", name)
+	}
+	return name, db, nil
+}
+
+// closeDatabases は全ての接続を閉じます。
+func closeDatabases() {
+	for _, d := range databases {
+		d.db.Close()
+	}
+}
+
+// sqlRunner は *sql.DB と *sql.Tx の共通部分です。
+type sqlRunner interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// sqlArgs は JS の引数（配列なら ? の位置、オブジェクトなら :name などの名前付き）を変換します。
+func sqlArgs(v goja.Value) ([]any, error) {
+	if isNullish(v) {
+		return nil, nil
+	}
+	switch a := v.Export().(type) {
+	case []any:
+		return a, nil
+	case map[string]any:
+		names := make([]string, 0, len(a))
+		for k := range a {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		args := make([]any, 0, len(a))
+		for _, k := range names {
+			args = append(args, sql.Named(k, a[k]))
+		}
+		return args, nil
+	}
+	return nil, fmt.Errorf("parameters must be an array or an object")
+}
+
+// queryRows は結果を列の順序どおりのオブジェクトの配列にします（nyanOutputColumns と同じ列名）。
+func queryRows(ctx context.Context, vm *goja.Runtime, r sqlRunner, query string, params goja.Value) (goja.Value, error) {
+	args, err := sqlArgs(params)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []any{}
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		obj := vm.NewObject()
+		for i, col := range cols {
+			obj.Set(col, sqlValue(values[i]))
+		}
+		result = append(result, obj)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return vm.ToValue(result), nil
+}
+
+// sqlValue はドライバーの値を JS で扱いやすい値にします。
+func sqlValue(v any) any {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// execSQL は INSERT / UPDATE などを実行し、{rowsAffected, lastInsertId} を返します。
+func execSQL(ctx context.Context, r sqlRunner, query string, params goja.Value) (map[string]any, error) {
+	args, err := sqlArgs(params)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{}
+	if n, err := res.RowsAffected(); err == nil {
+		out["rowsAffected"] = n
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		out["lastInsertId"] = id
+	}
+	return out, nil
+}
+
+// dbBindings は nyanDB が返すオブジェクトの実装です。
+type dbBindings struct {
+	vm   *goja.Runtime
+	sr   *scriptRequest
+	name string
+	db   *sqlDatabase
+}
+
+func (b dbBindings) ctx() context.Context {
+	if b.sr.Request != nil {
+		// 呼び出し元が切断したら実行中のクエリも止める
+		return b.sr.Request.Context()
+	}
+	return context.Background()
+}
+
+// statementCtx は 1 つの query / exec に statement_timeout_ms を適用します。
+// トランザクション全体には適用しないよう、begin には ctx を使います。
+func (b dbBindings) statementCtx() (context.Context, context.CancelFunc) {
+	if b.db.statementTimeout > 0 {
+		return context.WithTimeout(b.ctx(), b.db.statementTimeout)
+	}
+	return context.WithCancel(b.ctx())
+}
+
+func (b dbBindings) throw(err error) {
+	panic(b.vm.NewGoError(fmt.Errorf("nyanDB(%s): %w", b.name, err)))
+}
+
+// runnerObject は query / exec を持つオブジェクトを作ります（接続・トランザクション共通）。
+func (b dbBindings) runnerObject(r sqlRunner) *goja.Object {
+	obj := b.vm.NewObject()
+	obj.Set("query", func(query string, params goja.Value) goja.Value {
+		ctx, cancel := b.statementCtx()
+		defer cancel()
+		v, err := queryRows(ctx, b.vm, r, query, params)
+		if err != nil {
+			b.throw(err)
+		}
+		return v
+	})
+	obj.Set("exec", func(query string, params goja.Value) map[string]any {
+		ctx, cancel := b.statementCtx()
+		defer cancel()
+		res, err := execSQL(ctx, r, query, params)
+		if err != nil {
+			b.throw(err)
+		}
+		return res
+	})
+	return obj
+}
+
+// begin はトランザクションを開始します。commit も rollback もされずにスクリプトが終わった場合はロールバックします。
+func (b dbBindings) begin() (*sql.Tx, *goja.Object) {
+	tx, err := b.db.db.BeginTx(b.ctx(), nil)
+	if err != nil {
+		b.throw(err)
+	}
+	var once sync.Once
+	finish := func(commit bool) error {
+		err := sql.ErrTxDone
+		once.Do(func() {
+			if commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+		})
+		return err
+	}
+	b.sr.onFinish(func() {
+		if finish(false) == nil {
+			logger.Printf("nyanDB(%s): rolled back a transaction left open by the script", b.name)
+		}
+	})
+
+	obj := b.runnerObject(tx)
+	obj.Set("commit", func() {
+		if err := finish(true); err != nil {
+			b.throw(err)
+		}
+	})
+	obj.Set("rollback", func() {
+		if err := finish(false); err != nil {
+			b.throw(err)
+		}
+	})
+	return tx, obj
+}
+
+func (b dbBindings) object() *goja.Object {
+	obj := b.runnerObject(b.db.db)
+	obj.Set("begin", func() *goja.Object {
+		_, txObj := b.begin()
+		return txObj
+	})
+	// transaction(fn) は fn が例外を投げればロールバック、そうでなければコミットします。
+	obj.Set("transaction", func(fn goja.Callable) goja.Value {
+		tx, txObj := b.begin()
+		v, err := fn(goja.Undefined(), txObj)
+		if err != nil {
+			tx.Rollback()
+			panic(err)
+		}
+		if err := tx.Commit(); err != nil && err != sql.ErrTxDone {
+			b.throw(err)
+		}
+		return v
+	})
+	return obj
+}
+
+// setupDatabaseBindings は nyanDB を登録します（db 機能が必要）。
+// nyanDB("名前") は config.json の databases の接続を返します。接続が 1 つだけなら名前を省略できます。
+func setupDatabaseBindings(vm *goja.Runtime, sr *scriptRequest) {
+	setCapabilityBinding(vm, sr, "db", "nyanDB", func(call goja.FunctionCall) goja.Value {
+		name := ""
+		if arg := call.Argument(0); !isNullish(arg) {
+			name = arg.String()
+		}
+		name, db, err := lookupDatabase(name)
+		if err != nil {
+			panic(vm.NewGoError(fmt.Errorf("nyanDB: %w", err)))
+		}
+		sr.Caps.require(vm, sr, "db", name)
+		return dbBindings{vm: vm, sr: sr, name: name, db: db}.object()
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errPathEscapes はルートの外を指すパスの場合のエラーです。
+var errPathEscapes = errors.New("path escapes the file root")
+
+// resolveScriptPath はスクリプトから渡されたパスを、ファイルルートの中の実パスに解決します。
+//
+// config.json の fs_roots が無い場合は実行ディレクトリがルートです。
+// fs_roots がある場合は先頭の要素がルート名になります（例: "data/report.csv"）。
+// 絶対パス・".." を含むパス・シンボリックリンクでルートの外に出るパスはエラーになります。
+func resolveScriptPath(p string) (string, error) {
+	if p == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	slashed := filepath.ToSlash(p)
+	if filepath.IsAbs(p) || path.IsAbs(slashed) || filepath.VolumeName(p) != "" {
+		return "", fmt.Errorf("%w: absolute paths are not allowed (%s)", errPathEscapes, p)
+	}
+	for _, seg := range strings.Split(slashed, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("%w: %s", errPathEscapes, p)
+		}
+	}
+	rel := path.Clean(slashed)
+
+	root := getBaseDir()
+	if roots := globalConfig.FSRoots; len(roots) > 0 {
+		name, rest, _ := strings.Cut(rel, "/")
+		dir, ok := roots[name]
+		if !ok {
+			return "", fmt.Errorf("unknown file root %q (configure fs_roots in config.json)", name)
+		}
+		r, err := resolvePath(getBaseDir(), dir)
+		if err != nil {
+			return "", fmt.Errorf("invalid fs_roots.%s: %w", name, err)
+		}
+		root, rel = r, rest
+		if rel == "" {
+			rel = "."
+		}
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("file root is not accessible: %w", err)
+	}
+	full := filepath.Join(realRoot, filepath.FromSlash(rel))
+
+	// シンボリックリンクを辿った先もルート内であること（存在しない場合は親ディレクトリで判定）
+	real, err := evalExistingPrefix(full)
+	if err != nil {
+		return "", err
+	}
+	if !pathWithin(realRoot, real) {
+		return "", fmt.Errorf("%w: %s", errPathEscapes, p)
+	}
+	return real, nil
+}
+
+// evalExistingPrefix は存在する最も深い祖先までシンボリックリンクを解決し、残りを連結して返します。
+func evalExistingPrefix(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err == nil {
+		return real, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	parent := filepath.Dir(p)
+	if parent == p {
+		return p, nil
+	}
+	realParent, err := evalExistingPrefix(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(realParent, filepath.Base(p)), nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ExecConfig は nyanHostExec / nyanSpawn の設定です（config.json の exec）。
+type ExecConfig struct {
+	Allow                 []string `json:"allow"`                    // 実行を許可するコマンド（絶対パスまたはコマンド名）。空なら制限なし
+	AllowShell            *bool    `json:"allow_shell"`              // 文字列形式（シェル経由）を許可するか。既定は allow が空なら true
+	DefaultTimeoutMs      int      `json:"default_timeout_ms"`       // timeoutMs 未指定時の上限。0 なら無制限
+	MaxOutputBytes        int      `json:"max_output_bytes"`         // stdout / stderr それぞれの上限。0 なら 10MB
+	InheritEnv            []string `json:"inherit_env"`              // オブジェクト形式で引き継ぐ環境変数。空なら PATH / HOME / LANG など
+	AllowEnv              []string `json:"allow_env"`                // スクリプトが env で指定できる環境変数。空なら execDeniedEnv 以外
+	SpawnDefaultTimeoutMs int      `json:"spawn_default_timeout_ms"` // nyanSpawn で timeoutMs 未指定時の上限。0 なら default_timeout_ms
+	MaxProcesses          int      `json:"max_processes"`            // nyanSpawn で記録するプロセス数（実行中と終了後の保持分）の上限。0 なら 32
+	SpawnMaxWaitMs        int      `json:"spawn_max_wait_ms"`        // nyanSpawn のハンドルの wait() で待つ時間の上限。0 なら 30000
+}
+
+// ExecOptions は nyanHostExec のオブジェクト形式の引数です。
+type ExecOptions struct {
+	Cmd            string
+	Path           string // 解決済みの実行ファイル
+	Args           []string
+	Dir            string
+	Env            map[string]string
+	Stdin          string
+	Timeout        time.Duration
+	MaxOutputBytes int
+}
+
+const defaultExecMaxOutput = 10 << 20
+
+// 既定で子プロセスに引き継ぐ環境変数
+var defaultExecInheritEnv = []string{
+	"PATH", "HOME", "USER", "LANG", "LC_ALL", "TZ", "TMPDIR",
+	"SYSTEMROOT", "COMSPEC", "PATHEXT", "TEMP", "TMP", "WINDIR",
+}
+
+// スクリプトが env で指定できない環境変数。
+// 許可したコマンドでも、読み込むライブラリやスクリプトを差し替えて任意のコードを実行できてしまうため。
+var (
+	execDeniedEnvPrefixes = []string{"LD_", "DYLD_"}
+	execDeniedEnv         = []string{
+		"BASH_ENV", "ENV", "GCONV_PATH", "NODE_OPTIONS", "PERL5OPT", "PERL5LIB", "PERLLIB",
+		"PYTHONHOME", "PYTHONPATH", "PYTHONSTARTUP", "RUBYLIB", "RUBYOPT", "JAVA_TOOL_OPTIONS", "_JAVA_OPTIONS",
+	}
+)
+
+// checkExecEnvName は env の名前がスクリプトから指定できるものか確認します。
+// 動的ローダーの変数（LD_* / DYLD_*）は exec.allow_env に書いても拒否します。
+func checkExecEnvName(name string) error {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return fmt.Errorf("invalid env name %q", name)
+	}
+	upper := strings.ToUpper(name) // Windows では大文字・小文字を区別しない
+	for _, p := range execDeniedEnvPrefixes {
+		if strings.HasPrefix(upper, p) {
+			return fmt.Errorf("env %s is not allowed", name)
+		}
+	}
+	if allow := globalConfig.Exec.AllowEnv; len(allow) > 0 {
+		for _, a := range allow {
+			if strings.EqualFold(a, name) {
+				return nil
+			}
+		}
+		return fmt.Errorf("env %s is not in exec.allow_env", name)
+	}
+	for _, d := range execDeniedEnv {
+		if upper == d {
+			return fmt.Errorf("env %s is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// parseExecOptions は {cmd, args, cwd, env, stdin, timeoutMs, maxOutputBytes} を解析し、
+// exec.allow に従ってコマンドを確認します。
+func parseExecOptions(obj map[string]any) (*ExecOptions, error) {
+	cmd, _ := obj["cmd"].(string)
+	if cmd == "" {
+		return nil, fmt.Errorf("cmd is required")
+	}
+	path, err := resolveExecProgram(cmd)
+	if err != nil {
+		return nil, err
+	}
+	opts := &ExecOptions{
+		Cmd:            cmd,
+		Path:           path,
+		Timeout:        time.Duration(globalConfig.Exec.DefaultTimeoutMs) * time.Millisecond,
+		MaxOutputBytes: execMaxOutput(),
+	}
+	// args は空白で分割しない（配列の要素をそのまま 1 引数として渡す）
+	if raw, ok := obj["args"].([]any); ok {
+		opts.Args = make([]string, 0, len(raw))
+		for _, a := range raw {
+			opts.Args = append(opts.Args, fmt.Sprint(a))
+		}
+	} else if _, ok := obj["args"]; ok {
+		return nil, fmt.Errorf("args must be an array")
+	}
+	if cwd, _ := obj["cwd"].(string); cwd != "" {
+		dir, err := resolveScriptPath(cwd)
+		if err != nil {
+			return nil, fmt.Errorf("cwd: %w", err)
+		}
+		opts.Dir = dir
+	}
+	if env, ok := obj["env"].(map[string]any); ok {
+		opts.Env = map[string]string{}
+		for k, v := range env {
+			if err := checkExecEnvName(k); err != nil {
+				return nil, err
+			}
+			opts.Env[k] = fmt.Sprint(v)
+		}
+	}
+	if stdin, ok := obj["stdin"].(string); ok {
+		opts.Stdin = stdin
+	}
+	if ms, ok := toInt(obj["timeoutMs"]); ok && ms > 0 {
+		opts.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	if n, ok := toInt(obj["maxOutputBytes"]); ok && n > 0 && n < opts.MaxOutputBytes {
+		opts.MaxOutputBytes = n
+	}
+	return opts, nil
+}
+
+// resolveExecProgram はコマンドを実行ファイルの絶対パスに解決し、exec.allow を確認します。
+// スクリプトが置いたファイルを実行できないよう、相対パス（"./x" など）は受け付けません。
+func resolveExecProgram(cmd string) (string, error) {
+	if !filepath.IsAbs(cmd) && strings.ContainsAny(cmd, `/\`) {
+		return "", fmt.Errorf("cmd must be an absolute path or a command name: %s", cmd)
+	}
+	path, err := exec.LookPath(cmd)
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", err
+	}
+	if !execProgramAllowed(cmd, path) {
+		return "", fmt.Errorf("command is not in exec.allow: %s", cmd)
+	}
+	return path, nil
+}
+
+// execProgramAllowed は exec.allow にコマンド名または解決済みのパスがあるかを返します。
+func execProgramAllowed(cmd, path string) bool {
+	allow := globalConfig.Exec.Allow
+	if len(allow) == 0 {
+		return true
+	}
+	for _, a := range allow {
+		if a == path || (a == cmd && !strings.ContainsAny(a, `/\`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkShellExecAllowed は文字列形式（シェル経由）の実行が許可されているか確認します。
+func checkShellExecAllowed() error {
+	e := globalConfig.Exec
+	allowed := len(e.Allow) == 0
+	if e.AllowShell != nil {
+		allowed = *e.AllowShell
+	}
+	if !allowed {
+		return fmt.Errorf("shell commands are disabled; use nyanHostExec({cmd, args})")
+	}
+	return nil
+}
+
+func execMaxOutput() int {
+	if n := globalConfig.Exec.MaxOutputBytes; n > 0 {
+		return n
+	}
+	return defaultExecMaxOutput
+}
+
+// execEnv は引き継ぐ環境変数にスクリプト指定の env を重ねます。
+func execEnv(extra map[string]string) []string {
+	names := globalConfig.Exec.InheritEnv
+	if len(names) == 0 {
+		names = defaultExecInheritEnv
+	}
+	env := []string{}
+	for _, name := range names {
+		if v, ok := os.LookupEnv(name); ok {
+			if _, overridden := extra[name]; !overridden {
+				env = append(env, name+"="+v)
+			}
+		}
+	}
+	for k, v := range extra {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// execCommand は、指定されたコマンドをシェル経由で実行し、結果を返す
+func execCommand(commandLine string) (*ExecResult, error) {
+	ctx, cancel := execContext(time.Duration(globalConfig.Exec.DefaultTimeoutMs) * time.Millisecond)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", commandLine)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", commandLine)
+	}
+	return runExecCmd(ctx, cmd, "", execMaxOutput())
+}
+
+// runHostExec はオブジェクト形式のコマンドをシェルを介さずに実行します。
+func runHostExec(opts *ExecOptions) (*ExecResult, error) {
+	ctx, cancel := execContext(opts.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, opts.Path, opts.Args...)
+	cmd.Dir = opts.Dir
+	cmd.Env = execEnv(opts.Env)
+	return runExecCmd(ctx, cmd, opts.Stdin, opts.MaxOutputBytes)
+}
+
+func execContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// runExecCmd はコマンドを実行して出力を集めます。
+// 起動に失敗した場合は結果 nil、終了コードが 0 以外・タイムアウトの場合は結果とエラーの両方を返します。
+func runExecCmd(ctx context.Context, cmd *exec.Cmd, stdin string, maxOutput int) (*ExecResult, error) {
+	stdoutBuf := &limitedBuffer{limit: maxOutput}
+	stderrBuf := &limitedBuffer{limit: maxOutput}
+	cmd.Stdout = stdoutBuf
+	cmd.Stderr = stderrBuf
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	// タイムアウト後に孫プロセスが出力を握ったままでも戻れるようにする
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+
+	result := &ExecResult{
+		Stdout:    decodeCommandOutput(stdoutBuf.Bytes()),
+		Stderr:    decodeCommandOutput(stderrBuf.Bytes()),
+		Truncated: stdoutBuf.truncated || stderrBuf.truncated,
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.TimedOut = true
+		result.ExitCode = -1
+		return result, fmt.Errorf("command timed out")
+	}
+	if err != nil {
+		// 終了コードを取得
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+			return result, fmt.Errorf("failed to exec: %w", err)
+		}
+		return nil, fmt.Errorf("failed to exec: %w", err)
+	}
+
+	result.Success = true
+	return result, nil
+}
+
+// decodeCommandOutput は Windows なら Shift-JIS → UTF-8 変換を試み、それ以外の OS ではそのまま UTF-8 として扱います。
+func decodeCommandOutput(b []byte) string {
+	if runtime.GOOS == "windows" {
+		if s, err := convertShiftJISToUTF8(b); err == nil {
+			return s
+		}
+	}
+	return string(b)
+}
+
+// limitedBuffer は上限を超えた分を捨てるバッファです。
+// io.Copy が ReadFrom で上限を迂回しないよう、bytes.Buffer は埋め込まずに持ちます。
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room <= 0 {
+			return n, nil
+		}
+		p = p[:room]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func toInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), true
+	case int:
+		return n, true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPFilterConfig は IP アドレスによるアクセス制限です（config.json の ip_filter）。
+// allow / deny は全てのリクエストに、それ以外は各エンドポイントに追加で適用されます。
+type IPFilterConfig struct {
+	Allow   []string `json:"allow"`
+	Deny    []string `json:"deny"`
+	Catalog IPRule   `json:"catalog"` // /nyan, /nyan/:apiName
+	RPC     IPRule   `json:"rpc"`     // /nyan-rpc
+	MCP     IPRule   `json:"mcp"`     // /nyan-toolbox
+	Admin   IPRule   `json:"admin"`   // /nyan-admin
+}
+
+// IPRule は許可・拒否する IP / CIDR の一覧です。api.json の ip_filter にも使います。
+// deny に一致すれば拒否し、allow が空でなければ一致したものだけ許可します。
+type IPRule struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ipMatcher は解析済みの IPRule です。
+type ipMatcher struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+var (
+	// 起動時に解析したエンドポイントごとのルール
+	ipFilters = map[string]*ipMatcher{}
+
+	// 全てのアドレスを拒否するルール（設定が不正な場合に使う）
+	denyAllIPs = &ipMatcher{deny: []*net.IPNet{
+		{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+	}}
+)
+
+// initIPFilters は config.json の ip_filter を解析します。
+func initIPFilters() error {
+	f := globalConfig.IPFilter
+	rules := map[string]IPRule{
+		"global":  {Allow: f.Allow, Deny: f.Deny},
+		"catalog": f.Catalog,
+		"rpc":     f.RPC,
+		"mcp":     f.MCP,
+		"admin":   f.Admin,
+	}
+	for name, rule := range rules {
+		m, err := rule.compile()
+		if err != nil {
+			return fmt.Errorf("invalid ip_filter (%s): %w", name, err)
+		}
+		ipFilters[name] = m
+	}
+	return nil
+}
+
+func (r IPRule) compile() (*ipMatcher, error) {
+	allow, err := parseCIDRList(r.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRList(r.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipMatcher{allow: allow, deny: deny}, nil
+}
+
+// allows は IP アドレスがルールで許可されるかを返します。
+func (m *ipMatcher) allows(ipStr string) bool {
+	if m == nil || (len(m.allow) == 0 && len(m.deny) == 0) {
+		return true
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	if ipInNets(ip, m.deny) {
+		return false
+	}
+	return len(m.allow) == 0 || ipInNets(ip, m.allow)
+}
+
+// IPFilterMiddleware は config.json の ip_filter（name で指定したルール）でリクエストを制限します。
+func IPFilterMiddleware(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rejectByIPFilter(c, name) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// rejectByIPFilter は ip_filter の name のルールで呼び出し元を拒否する場合に 403 を返し、true を返します。
+// ルート以外の入口（?api=nyan など）から呼ばれるハンドラーはこれで直接確認します。
+func rejectByIPFilter(c *gin.Context, name string) bool {
+	ip := getClientIP(c.Request)
+	if ipFilters[name].allows(ip) {
+		return false
+	}
+	logger.Printf("IPFilter: rejected %s %s from %s", c.Request.Method, c.Request.URL.Path, ip)
+	respondGuardError(c, &apiGuardError{Status: http.StatusForbidden, Message: "Forbidden"})
+	return true
+}
+
+// apiIPRule は api.json の ip_filter を解析します。不正な設定は全て拒否します。
+func apiIPRule(apiInfo map[string]any) *ipMatcher {
+	raw, ok := apiInfo["ip_filter"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	js, _ := json.Marshal(raw)
+	var rule IPRule
+	if err := json.Unmarshal(js, &rule); err != nil {
+		logger.Printf("Invalid ip_filter setting in api.json: %v", err)
+		return denyAllIPs
+	}
+	m, err := rule.compile()
+	if err != nil {
+		logger.Printf("Invalid ip_filter setting in api.json: %v", err)
+		return denyAllIPs
+	}
+	return m
+}
+
+// apiIPAllowed は呼び出し元の IP が api.json の ip_filter で許可されるかを返します。
+// stdio モードなど HTTP リクエストを伴わない場合は常に許可します。
+func apiIPAllowed(c *gin.Context, apiInfo map[string]any) bool {
+	if c == nil {
+		return true
+	}
+	return apiIPRule(apiInfo).allows(getClientIP(c.Request))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig は JWT 検証の設定です。
+type JWTConfig struct {
+	Secret     string   `json:"secret"`      // HS256 の共有鍵（環境変数展開可）
+	JWKSFile   string   `json:"jwks_file"`   // RS256 / ES256 の公開鍵（JWKS 形式のローカルファイル）
+	Algorithms []string `json:"algorithms"`  // 許可するアルゴリズム。空なら鍵のあるもの全て
+	Issuer     string   `json:"issuer"`      // iss の期待値（空なら検証しない）
+	Audience   string   `json:"audience"`    // aud の期待値（空なら検証しない）
+	Leeway     int      `json:"leeway"`      // exp / nbf の許容誤差（秒）
+	RequireExp *bool    `json:"require_exp"` // exp の無いトークンを拒否するか（既定 true）
+	RolesClaim string   `json:"roles_claim"` // ロールを読むクレーム名（既定 roles）
+	ScopeClaim string   `json:"scope_claim"` // スコープを読むクレーム名（既定 scope）
+}
+
+// jwk は JWKS の 1 鍵です。
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var (
+	jwtKeys   map[string]crypto.PublicKey // kid -> 公開鍵（kid 無しは ""）
+	jwtKeysMu sync.RWMutex
+)
+
+// initJWTKeys は jwks_file を読み込みます。
+func initJWTKeys(execDir string) error {
+	j := globalConfig.Auth.JWT
+	if j.JWKSFile == "" {
+		return nil
+	}
+	p, err := resolvePath(execDir, j.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("invalid auth.jwt.jwks_file: %w", err)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", p, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for i, k := range set.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("%s: key %d: %w", p, i, err)
+		}
+		keys[k.Kid] = pub
+	}
+	jwtKeysMu.Lock()
+	jwtKeys = keys
+	jwtKeysMu.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e: %w", err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+}
+
+func jwtConfigured() bool {
+	j := globalConfig.Auth.JWT
+	return j.Secret != "" || j.JWKSFile != ""
+}
+
+func jwtAlgorithmAllowed(alg string) bool {
+	if allowed := globalConfig.Auth.JWT.Algorithms; len(allowed) > 0 {
+		return containsString(allowed, alg)
+	}
+	return alg == "HS256" || alg == "RS256" || alg == "ES256"
+}
+
+// verifyJWT は署名と標準クレーム（exp / nbf / iss / aud）を検証し、クレームを返します。
+func verifyJWT(token string) (map[string]any, error) {
+	j := globalConfig.Auth.JWT
+	if !jwtConfigured() {
+		return nil, fmt.Errorf("JWT is not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header")
+	}
+	if !jwtAlgorithmAllowed(header.Alg) {
+		return nil, fmt.Errorf("JWT algorithm %q is not allowed", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	switch header.Alg {
+	case "HS256":
+		secret := os.ExpandEnv(j.Secret)
+		if secret == "" {
+			return nil, fmt.Errorf("HS256 secret is not configured")
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+	case "RS256":
+		pub, ok := lookupJWTKey(header.Kid).(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("no RSA key for kid %q", header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+	case "ES256":
+		pub, ok := lookupJWTKey(header.Kid).(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("no EC key for kid %q", header.Kid)
+		}
+		if len(sig) != 64 {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+	default:
+		return nil, fmt.Errorf("JWT algorithm %q is not supported", header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims")
+	}
+	if err := validateJWTClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func validateJWTClaims(claims map[string]any) error {
+	j := globalConfig.Auth.JWT
+	now := time.Now().Unix()
+	leeway := int64(j.Leeway)
+	exp, ok := claims["exp"].(float64)
+	if !ok && (j.RequireExp == nil || *j.RequireExp) {
+		// 期限の無いトークンは漏れると取り消せないため、明示的に許可した場合のみ受け付ける
+		return fmt.Errorf("JWT has no exp claim")
+	}
+	if ok && now > int64(exp)+leeway {
+		return fmt.Errorf("JWT is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now+leeway < int64(nbf) {
+		return fmt.Errorf("JWT is not yet valid")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return fmt.Errorf("JWT issuer mismatch")
+	}
+	if j.Audience != "" {
+		match := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			match = aud == j.Audience
+		case []any:
+			for _, a := range aud {
+				if a == j.Audience {
+					match = true
+				}
+			}
+		}
+		if !match {
+			return fmt.Errorf("JWT audience mismatch")
+		}
+	}
+	return nil
+}
+
+// lookupJWTKey は kid に対応する公開鍵を返します。kid が無い場合は鍵が 1 つだけならそれを使います。
+func lookupJWTKey(kid string) crypto.PublicKey {
+	jwtKeysMu.RLock()
+	defer jwtKeysMu.RUnlock()
+	if k, ok := jwtKeys[kid]; ok {
+		return k
+	}
+	if kid == "" && len(jwtKeys) == 1 {
+		for _, k := range jwtKeys {
+			return k
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// principalFromClaims は JWT のクレームから呼び出し元を作ります。
+func principalFromClaims(claims map[string]any) *Principal {
+	j := globalConfig.Auth.JWT
+	rolesClaim := j.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	scopeClaim := j.ScopeClaim
+	if scopeClaim == "" {
+		scopeClaim = "scope"
+	}
+	sub, _ := claims["sub"].(string)
+	return &Principal{
+		Method:  "jwt",
+		Subject: sub,
+		Roles:   claimStrings(claims[rolesClaim]),
+		Scopes:  claimStrings(claims[scopeClaim]),
+		Claims:  claims,
+	}
+}
+
+// claimStrings は "a b" / "a,b" / ["a","b"] のいずれの形式も文字列配列にします。
+func claimStrings(v any) []string {
+	switch t := v.(type) {
+	case string:
+		return splitList(t)
+	case []any:
+		out := make([]string, 0, len(t))
+		for _, x := range t {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return []string{}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StorageConfig は nyanSetItem / nyanGetItem の保存先です（config.json の storage）。
+type StorageConfig struct {
+	Type          string `json:"type"`           // bolt（既定）/ memory
+	Path          string `json:"path"`           // type=bolt のファイル。既定は実行ディレクトリの storage.db
+	PurgeInterval int    `json:"purge_interval"` // 期限切れのキーを削除する間隔（秒）。0 なら 60
+}
+
+// kvEntry は保存された値です。
+type kvEntry struct {
+	Value     []byte    // JSON
+	ExpiresAt time.Time // ゼロ値なら期限なし
+}
+
+func (e *kvEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// kvUpdateFunc は現在の値（無いか期限切れなら nil）から次の値を決めます。
+// write が false なら何もせず、next が nil なら削除します。
+type kvUpdateFunc func(cur *kvEntry) (next *kvEntry, write bool, err error)
+
+// kvStore はスクリプトから使う key-value ストレージの保存先です。
+// update は同じキーへの他の更新と混ざらないように実行します（読み取り→書き込みの競合を防ぐ）。
+type kvStore interface {
+	get(key string) (*kvEntry, error)
+	update(key string, fn kvUpdateFunc) error
+	keys(prefix string) ([]string, error)
+	purgeExpired(now time.Time) (int, error)
+	close() error
+}
+
+var storage kvStore = newMemoryKVStore()
+
+// initStorage は storage の設定に従って保存先を開き、期限切れの掃除を始めます。
+// memoryOnly なら bolt のファイルを開かず（ロックせず）、プロセス内の保存先を使います。
+func initStorage(execDir string, memoryOnly bool) error {
+	st := globalConfig.Storage
+	switch st.Type {
+	case "", "bolt":
+		if memoryOnly {
+			break
+		}
+		p := st.Path
+		if p == "" {
+			p = "storage.db"
+		}
+		path, err := resolvePath(execDir, p)
+		if err != nil {
+			return fmt.Errorf("invalid storage.path: %w", err)
+		}
+		s, err := openBoltKVStore(path)
+		if err != nil {
+			return err
+		}
+		storage = s
+	case "memory":
+	default:
+		return fmt.Errorf("unknown storage.type %q", st.Type)
+	}
+	go storageJanitor(ttlSeconds(st.PurgeInterval, 60))
+	return nil
+}
+
+// storageJanitor は期限切れのキーを定期的に削除します。
+func storageJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		n, err := storage.purgeExpired(now)
+		if err != nil {
+			logger.Printf("Storage: failed to purge expired keys: %v", err)
+		} else if n > 0 {
+			logger.Printf("Storage: purged %d expired keys", n)
+		}
+	}
+}
+
+// memoryKVStore はプロセス内だけの保存先です（再起動で消えます）。
+type memoryKVStore struct {
+	mu    sync.RWMutex
+	items map[string]kvEntry
+}
+
+func newMemoryKVStore() *memoryKVStore {
+	return &memoryKVStore{items: map[string]kvEntry{}}
+}
+
+func (s *memoryKVStore) get(key string) (*kvEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.items[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+func (s *memoryKVStore) update(key string, fn kvUpdateFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cur *kvEntry
+	if e, ok := s.items[key]; ok && !e.expired(time.Now()) {
+		cur = &e
+	}
+	next, write, err := fn(cur)
+	if err != nil || !write {
+		return err
+	}
+	if next == nil {
+		delete(s.items, key)
+	} else {
+		s.items[key] = *next
+	}
+	return nil
+}
+
+func (s *memoryKVStore) keys(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	keys := []string{}
+	for k, e := range s.items {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *memoryKVStore) purgeExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, e := range s.items {
+		if e.expired(now) {
+			delete(s.items, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryKVStore) close() error { return nil }
+
+// boltKVStore は bbolt のファイルに保存します。
+// 値は items、期限は expires（キー -> UnixNano）のバケットに分けて持ちます。
+type boltKVStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltItemsBucket   = []byte("items")
+	boltExpiresBucket = []byte("expires")
+)
+
+func openBoltKVStore(path string) (*boltKVStore, error) {
+	// 別のプロセスが開いている場合に起動を止めたままにしない
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltItemsBucket, boltExpiresBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltKVStore{db: db}, nil
+}
+
+// boltEntry はトランザクション内で値を読み取ります（期限切れなら nil）。
+func boltEntry(tx *bolt.Tx, key []byte, now time.Time) *kvEntry {
+	v := tx.Bucket(boltItemsBucket).Get(key)
+	if v == nil {
+		return nil
+	}
+	// トランザクションの外で使うのでコピーする
+	e := &kvEntry{Value: append([]byte{}, v...)}
+	if exp := tx.Bucket(boltExpiresBucket).Get(key); len(exp) == 8 {
+		e.ExpiresAt = time.Unix(0, int64(binary.BigEndian.Uint64(exp)))
+	}
+	if e.expired(now) {
+		return nil
+	}
+	return e
+}
+
+func (s *boltKVStore) get(key string) (*kvEntry, error) {
+	var e *kvEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		e = boltEntry(tx, []byte(key), time.Now())
+		return nil
+	})
+	return e, err
+}
+
+func (s *boltKVStore) update(key string, fn kvUpdateFunc) error {
+	// bbolt の書き込みトランザクションは 1 つずつ実行される
+	return s.db.Update(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		next, write, err := fn(boltEntry(tx, k, time.Now()))
+		if err != nil || !write {
+			return err
+		}
+		items, expires := tx.Bucket(boltItemsBucket), tx.Bucket(boltExpiresBucket)
+		if next == nil {
+			if err := items.Delete(k); err != nil {
+				return err
+			}
+			return expires.Delete(k)
+		}
+		if err := items.Put(k, next.Value); err != nil {
+			return err
+		}
+		if next.ExpiresAt.IsZero() {
+			return expires.Delete(k)
+		}
+		exp := make([]byte, 8)
+		binary.BigEndian.PutUint64(exp, uint64(next.ExpiresAt.UnixNano()))
+		return expires.Put(k, exp)
+	})
+}
+
+func (s *boltKVStore) keys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		c := tx.Bucket(boltItemsBucket).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			if boltEntry(tx, k, now) != nil {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s *boltKVStore) purgeExpired(now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		items, expires := tx.Bucket(boltItemsBucket), tx.Bucket(boltExpiresBucket)
+		var expired [][]byte
+		err := expires.ForEach(func(k, v []byte) error {
+			if len(v) == 8 && !now.Before(time.Unix(0, int64(binary.BigEndian.Uint64(v)))) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// ForEach の中では削除できないので後でまとめて消す
+		for _, k := range expired {
+			if err := items.Delete(k); err != nil {
+				return err
+			}
+			if err := expires.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltKVStore) close() error { return s.db.Close() }
+
+// kvNamespace はキーの名前空間です。
+// 既定の名前空間（nyanSetItem など）はキーをそのまま使い、それ以外は "名前\x00キー" で保存します。
+type kvNamespace struct {
+	prefix string
+}
+
+func newKVNamespace(name string) kvNamespace {
+	if name == "" {
+		return kvNamespace{}
+	}
+	return kvNamespace{prefix: name + "\x00"}
+}
+
+func (ns kvNamespace) key(k string) string { return ns.prefix + k }
+
+// list は名前空間内で prefix から始まるキーを、名前空間を除いて返します。
+func (ns kvNamespace) list(prefix string) ([]string, error) {
+	keys, err := storage.keys(ns.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, ns.prefix)
+		if ns.prefix == "" && strings.Contains(k, "\x00") {
+			continue // 名前付きの名前空間のキー
+		}
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+// kvSetOptions は {ttl: 秒} の指定です。
+type kvSetOptions struct {
+	TTL time.Duration
+}
+
+func parseKVSetOptions(v goja.Value) (kvSetOptions, error) {
+	var opts kvSetOptions
+	if isNullish(v) {
+		return opts, nil
+	}
+	obj, ok := v.Export().(map[string]any)
+	if !ok {
+		return opts, fmt.Errorf("options must be an object like {ttl: 60}")
+	}
+	if raw, ok := obj["ttl"]; ok {
+		var sec float64
+		switch n := raw.(type) {
+		case int64:
+			sec = float64(n)
+		case float64:
+			sec = n
+		default:
+			return opts, fmt.Errorf("ttl must be a number of seconds")
+		}
+		if sec <= 0 {
+			return opts, fmt.Errorf("ttl must be positive")
+		}
+		opts.TTL = time.Duration(sec * float64(time.Second))
+	}
+	return opts, nil
+}
+
+func (o kvSetOptions) entry(value []byte) *kvEntry {
+	e := &kvEntry{Value: value}
+	if o.TTL > 0 {
+		e.ExpiresAt = time.Now().Add(o.TTL)
+	}
+	return e
+}
+
+// isNullish は引数が省略されたか null / undefined かを返します。
+func isNullish(v goja.Value) bool {
+	return v == nil || goja.IsUndefined(v) || goja.IsNull(v)
+}
+
+// marshalKVValue は JS の値を保存用の JSON にします。
+func marshalKVValue(v goja.Value) ([]byte, error) {
+	if isNullish(v) {
+		return nil, nil
+	}
+	js, err := json.Marshal(v.Export())
+	if err != nil {
+		return nil, fmt.Errorf("value is not JSON serializable: %w", err)
+	}
+	return js, nil
+}
+
+// kvBindings は 1 つの名前空間に対する JS の関数群です。
+type kvBindings struct {
+	vm *goja.Runtime
+	ns kvNamespace
+}
+
+func (b kvBindings) throw(name string, err error) {
+	panic(b.vm.NewGoError(fmt.Errorf("%s: %w", name, err)))
+}
+
+// set は値を保存します（null / undefined は削除）。
+func (b kvBindings) set(k string, v goja.Value, opts goja.Value) {
+	o, err := parseKVSetOptions(opts)
+	if err != nil {
+		b.throw("nyanSetItem", err)
+	}
+	js, err := marshalKVValue(v)
+	if err != nil {
+		b.throw("nyanSetItem", err)
+	}
+	err = storage.update(b.key("nyanSetItem", k), func(*kvEntry) (*kvEntry, bool, error) {
+		if js == nil {
+			return nil, true, nil
+		}
+		return o.entry(js), true, nil
+	})
+	if err != nil {
+		b.throw("nyanSetItem", err)
+	}
+}
+
+// key は名前空間を付けたキーを返します。
+// "\x00" は名前空間の区切りのため、キーに含めると他の名前空間（nyanSession のデータなど）を指せてしまうので拒否します。
+func (b kvBindings) key(fn, k string) string {
+	if strings.Contains(k, "\x00") {
+		b.throw(fn, fmt.Errorf("invalid key %q", k))
+	}
+	return b.ns.key(k)
+}
+
+// get は値を返します（無い・期限切れなら null）。
+func (b kvBindings) get(k string) goja.Value {
+	e, err := storage.get(b.key("nyanGetItem", k))
+	if err != nil {
+		b.throw("nyanGetItem", err)
+	}
+	if e == nil {
+		return goja.Null()
+	}
+	var v any
+	if err := json.Unmarshal(e.Value, &v); err != nil {
+		return goja.Null()
+	}
+	return b.vm.ToValue(v)
+}
+
+func (b kvBindings) delete(k string) {
+	err := storage.update(b.key("nyanDeleteItem", k), func(*kvEntry) (*kvEntry, bool, error) {
+		return nil, true, nil
+	})
+	if err != nil {
+		b.throw("nyanDeleteItem", err)
+	}
+}
+
+func (b kvBindings) list(prefix string) []string {
+	if strings.Contains(prefix, "\x00") {
+		b.throw("nyanListItems", fmt.Errorf("invalid key prefix %q", prefix))
+	}
+	keys, err := b.ns.list(prefix)
+	if err != nil {
+		b.throw("nyanListItems", err)
+	}
+	return keys
+}
+
+// incr は数値に by（省略時 1）を加えた値を返します。キーが無ければ 0 から数え、ttl はその時だけ設定します。
+func (b kvBindings) incr(k string, by goja.Value, opts goja.Value) float64 {
+	delta := 1.0
+	if !isNullish(by) {
+		delta = by.ToFloat()
+	}
+	o, err := parseKVSetOptions(opts)
+	if err != nil {
+		b.throw("nyanIncrItem", err)
+	}
+	var result float64
+	err = storage.update(b.key("nyanIncrItem", k), func(cur *kvEntry) (*kvEntry, bool, error) {
+		next := o.entry(nil)
+		if cur != nil {
+			if err := json.Unmarshal(cur.Value, &result); err != nil {
+				return nil, false, fmt.Errorf("value of %q is not a number", k)
+			}
+			next.ExpiresAt = cur.ExpiresAt // 既存のキーの期限は変えない
+		}
+		result += delta
+		next.Value, _ = json.Marshal(result)
+		return next, true, nil
+	})
+	if err != nil {
+		b.throw("nyanIncrItem", err)
+	}
+	return result
+}
+
+// setIfAbsent はキーが無い（期限切れを含む）場合だけ保存し、保存したかを返します。
+func (b kvBindings) setIfAbsent(k string, v goja.Value, opts goja.Value) bool {
+	o, err := parseKVSetOptions(opts)
+	if err != nil {
+		b.throw("nyanSetItemIfAbsent", err)
+	}
+	js, err := marshalKVValue(v)
+	if err == nil && js == nil {
+		err = fmt.Errorf("value must not be null")
+	}
+	if err != nil {
+		b.throw("nyanSetItemIfAbsent", err)
+	}
+	stored := false
+	err = storage.update(b.key("nyanSetItemIfAbsent", k), func(cur *kvEntry) (*kvEntry, bool, error) {
+		if cur != nil {
+			return nil, false, nil
+		}
+		stored = true
+		return o.entry(js), true, nil
+	})
+	if err != nil {
+		b.throw("nyanSetItemIfAbsent", err)
+	}
+	return stored
+}
+
+// compareAndSet は現在の値が expected（JSON として等しい）の場合だけ next に置き換え、置き換えたかを返します。
+// expected が null なら「キーが無い」、next が null なら削除を意味します。
+func (b kvBindings) compareAndSet(k string, expected, next goja.Value, opts goja.Value) bool {
+	o, err := parseKVSetOptions(opts)
+	if err != nil {
+		b.throw("nyanCompareAndSetItem", err)
+	}
+	want, err := marshalKVValue(expected)
+	if err != nil {
+		b.throw("nyanCompareAndSetItem", err)
+	}
+	js, err := marshalKVValue(next)
+	if err != nil {
+		b.throw("nyanCompareAndSetItem", err)
+	}
+	swapped := false
+	err = storage.update(b.key("nyanCompareAndSetItem", k), func(cur *kvEntry) (*kvEntry, bool, error) {
+		switch {
+		case cur == nil && want != nil, cur != nil && !jsonEqual(cur.Value, want):
+			return nil, false, nil
+		}
+		swapped = true
+		if js == nil {
+			return nil, true, nil
+		}
+		return o.entry(js), true, nil
+	})
+	if err != nil {
+		b.throw("nyanCompareAndSetItem", err)
+	}
+	return swapped
+}
+
+// jsonEqual は 2 つの JSON が同じ値かを返します（オブジェクトのキー順や数値の書き方の違いは無視）。
+func jsonEqual(a, b []byte) bool {
+	if b == nil {
+		return false
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
+
+// object は nyanStorage() が返すオブジェクトを作ります。
+func (b kvBindings) object() *goja.Object {
+	obj := b.vm.NewObject()
+	obj.Set("get", b.get)
+	obj.Set("set", b.set)
+	obj.Set("delete", b.delete)
+	obj.Set("list", b.list)
+	obj.Set("incr", b.incr)
+	obj.Set("setIfAbsent", b.setIfAbsent)
+	obj.Set("compareAndSet", b.compareAndSet)
+	return obj
+}
+
+// setupStorageBindings は key-value ストレージの関数を登録します。
+// nyanSetItem などは全 API で共有する既定の名前空間、nyanStorage() は API ごと・名前付きの名前空間を扱います。
+func setupStorageBindings(vm *goja.Runtime, sr *scriptRequest) {
+	b := kvBindings{vm: vm}
+	vm.Set("nyanSetItem", b.set)
+	vm.Set("nyanGetItem", b.get)
+	vm.Set("nyanDeleteItem", b.delete)
+	vm.Set("nyanListItems", b.list)
+	vm.Set("nyanIncrItem", b.incr)
+	vm.Set("nyanSetItemIfAbsent", b.setIfAbsent)
+	vm.Set("nyanCompareAndSetItem", b.compareAndSet)
+
+	// nyanStorage() はこの API 専用、nyanStorage("名前") は同じ名前を使う API 間で共有します。
+	vm.Set("nyanStorage", func(call goja.FunctionCall) goja.Value {
+		name := ""
+		if arg := call.Argument(0); !isNullish(arg) {
+			name = arg.String()
+			if name == "" || strings.Contains(name, "\x00") {
+				panic(vm.NewGoError(fmt.Errorf("nyanStorage: invalid namespace %q", name)))
+			}
+			name = "ns:" + name
+		} else {
+			if sr.Caps == nil || sr.Caps.api == "" {
+				panic(vm.NewGoError(fmt.Errorf("nyanStorage: no API name in this context; pass a namespace name")))
+			}
+			name = "api:" + sr.Caps.api
+		}
+		return kvBindings{vm: vm, ns: newKVNamespace(name)}.object()
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpSecurity は smtp.security（未指定なら従来の smtp.tls）から接続方式を返します。
+//
+//	tls      … 接続直後から TLS（SMTPS、既定ポート 465）
+//	starttls … STARTTLS 必須（既定ポート 587）。サーバーが対応していなければ送信しない
+//	none     … 暗号化しない（既定ポート 25）
+//	""       … サーバーが対応していれば STARTTLS（既定ポート 25）
+func smtpSecurity(s SMTPConfig) (string, error) {
+	switch sec := strings.ToLower(s.Security); sec {
+	case "":
+		if s.TLS {
+			return "tls", nil
+		}
+		return "", nil
+	case "tls", "starttls", "none":
+		return sec, nil
+	default:
+		return "", fmt.Errorf("unknown smtp.security %q (none, starttls, tls)", s.Security)
+	}
+}
+
+// smtpAddr は接続先を返します。port が未指定なら接続方式の標準ポートを使います。
+func smtpAddr(s SMTPConfig, security string) string {
+	port := s.Port
+	if port == 0 {
+		switch security {
+		case "tls":
+			port = 465
+		case "starttls":
+			port = 587
+		default:
+			port = 25
+		}
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+// smtpAuth は smtp.auth から認証方式を返します（認証しない場合は nil）。
+// 未指定なら username があれば PLAIN、無ければ認証しません。
+func smtpAuth(s SMTPConfig) (smtp.Auth, error) {
+	mech := strings.ToLower(s.Auth)
+	if mech == "" {
+		if s.Username == "" {
+			return nil, nil
+		}
+		mech = "plain"
+	}
+	switch mech {
+	case "none":
+		return nil, nil
+	case "plain":
+		return smtp.PlainAuth("", s.Username, s.Password, s.Host), nil
+	case "login":
+		return &loginAuth{username: s.Username, password: s.Password, host: s.Host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(s.Username, s.Password), nil
+	case "xoauth2":
+		token := os.ExpandEnv(s.AccessToken)
+		if token == "" {
+			token = s.Password
+		}
+		return &xoauth2Auth{username: s.Username, token: token}, nil
+	}
+	return nil, fmt.Errorf("unknown smtp.auth %q (none, plain, login, cram-md5, xoauth2)", s.Auth)
+}
+
+// loginAuth は AUTH LOGIN です（net/smtp には無いため実装）。
+// PLAIN と同じく、暗号化されていない接続では localhost 以外に送りません。
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "user name", "username":
+		return []byte(a.username), nil
+	case "password:", "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// xoauth2Auth は Gmail / Microsoft 365 などの AUTH XOAUTH2 です。
+type xoauth2Auth struct {
+	username, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// 失敗時はエラー内容（JSON）が届くので、空の応答を返して最終的なエラーを受け取る
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// deliverSMTP は組み立て済みのメッセージを smtp の設定に従って送信します。
+// 接続は dial_timeout、その後の各コマンド（本文の送信を含む）は command_timeout で打ち切ります。
+func deliverSMTP(s SMTPConfig, from string, rcpts []string, msg []byte) error {
+	security, err := smtpSecurity(s)
+	if err != nil {
+		return err
+	}
+	auth, err := smtpAuth(s)
+	if err != nil {
+		return err
+	}
+	addr := smtpAddr(s, security)
+	tlsConf := &tls.Config{ServerName: s.Host, InsecureSkipVerify: s.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: ttlSeconds(s.DialTimeout, 10)}
+
+	var conn net.Conn
+	if security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp: connect %s: %w", addr, err)
+	}
+	commandTimeout := ttlSeconds(s.CommandTimeout, 60)
+	extend := func() { conn.SetDeadline(time.Now().Add(commandTimeout)) }
+
+	extend()
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp: %w", err)
+	}
+	defer c.Close()
+
+	if security == "starttls" || security == "" {
+		extend()
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			extend()
+			if err := c.StartTLS(tlsConf); err != nil {
+				return fmt.Errorf("smtp: STARTTLS: %w", err)
+			}
+		} else if security == "starttls" {
+			return fmt.Errorf("smtp: server %s does not support STARTTLS", addr)
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server %s does not support AUTH", addr)
+		}
+		extend()
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("smtp: auth: %w", err)
+		}
+	}
+
+	extend()
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("smtp: MAIL FROM: %w", err)
+	}
+	for _, r := range rcpts {
+		extend()
+		if err := c.Rcpt(r); err != nil {
+			return fmt.Errorf("smtp: RCPT TO %s: %w", r, err)
+		}
+	}
+	extend()
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	extend()
+	return c.Quit()
+}
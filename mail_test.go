@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP はテスト用の SMTP サーバーです（127.0.0.1 で待ち受け）。
+type fakeSMTP struct {
+	t           *testing.T
+	ln          net.Listener
+	tlsConf     *tls.Config
+	implicitTLS bool // 接続直後から TLS
+	startTLS    bool // STARTTLS を広告する
+	auth        bool // AUTH を広告する
+	silent      bool // 接続を受け付けるだけで何も返さない
+
+	mu       sync.Mutex
+	mech     string // 成功した認証方式
+	authUser string
+	tlsData  bool // DATA を TLS 上で受けたか
+	data     string
+}
+
+const (
+	fakeSMTPUser     = "user@example.com"
+	fakeSMTPPassword = "passw0rd"
+	fakeSMTPToken    = "ya29.token"
+)
+
+func newFakeSMTP(t *testing.T, configure func(*fakeSMTP)) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{t: t, ln: ln, tlsConf: &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}}
+	if configure != nil {
+		configure(f)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go f.serve()
+	return f
+}
+
+// config は送信先をこのサーバーにした smtp 設定を返します。
+func (f *fakeSMTP) config() SMTPConfig {
+	_, port, _ := net.SplitHostPort(f.ln.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return SMTPConfig{Host: "127.0.0.1", Port: n, FromEmail: "noreply@example.com", DialTimeout: 5, CommandTimeout: 5}
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	if f.silent {
+		// クライアントが諦めて切断するまで読み捨てる
+		io.Copy(io.Discard, conn)
+		return
+	}
+	isTLS := false
+	if f.implicitTLS {
+		conn = tls.Server(conn, f.tlsConf)
+		isTLS = true
+	}
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ext := []string{"fake"}
+			if f.startTLS && !isTLS {
+				ext = append(ext, "STARTTLS")
+			}
+			if f.auth {
+				ext = append(ext, "AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, e)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			conn = tls.Server(conn, f.tlsConf)
+			tp = textproto.NewConn(conn)
+			isTLS = true
+		case "AUTH":
+			f.authenticate(tp, arg)
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.data, f.tlsData = string(b), isTLS
+			f.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// authenticate は AUTH コマンドを処理し、成功したら方式と利用者を記録します。
+func (f *fakeSMTP) authenticate(tp *textproto.Conn, arg string) {
+	mech, initial, _ := strings.Cut(arg, " ")
+	mech = strings.ToUpper(mech)
+	challenge := func(s string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(s)))
+		line, _ := tp.ReadLine()
+		b, _ := base64.StdEncoding.DecodeString(line)
+		return string(b)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(initial)
+
+	var user string
+	ok := false
+	switch mech {
+	case "PLAIN":
+		parts := strings.Split(string(decoded), "\x00")
+		ok = len(parts) == 3 && parts[1] == fakeSMTPUser && parts[2] == fakeSMTPPassword
+		if len(parts) == 3 {
+			user = parts[1]
+		}
+	case "LOGIN":
+		user = challenge("Username:")
+		ok = user == fakeSMTPUser && challenge("Password:") == fakeSMTPPassword
+	case "CRAM-MD5":
+		nonce := "<1234.5678@fake>"
+		var digest string
+		user, digest, _ = strings.Cut(challenge(nonce), " ")
+		mac := hmac.New(md5.New, []byte(fakeSMTPPassword))
+		mac.Write([]byte(nonce))
+		ok = user == fakeSMTPUser && digest == hex.EncodeToString(mac.Sum(nil))
+	case "XOAUTH2":
+		want := "user=" + fakeSMTPUser + "\x01auth=Bearer " + fakeSMTPToken + "\x01\x01"
+		ok = string(decoded) == want
+		user = fakeSMTPUser
+		if !ok {
+			// 実際のサーバーと同じく、エラー内容を返してから空の応答を待つ
+			tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(`{"status":"401"}`)))
+			tp.ReadLine()
+		}
+	}
+	if !ok {
+		tp.PrintfLine("535 authentication failed")
+		return
+	}
+	f.mu.Lock()
+	f.mech, f.authUser = mech, user
+	f.mu.Unlock()
+	tp.PrintfLine("235 authenticated")
+}
+
+func (f *fakeSMTP) result() (mech, user string, tlsData bool, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mech, f.authUser, f.tlsData, f.data
+}
+
+// selfSignedCert は 127.0.0.1 用の自己署名証明書を作ります。
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake smtp"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+const testMessage = "Subject: test\r\n\r\nhello\r\n"
+
+func TestDeliverSMTPSecurity(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    func(*fakeSMTP)
+		security  string
+		legacyTLS bool
+		wantTLS   bool
+	}{
+		{name: "none", server: func(f *fakeSMTP) { f.startTLS = true }, security: "none", wantTLS: false},
+		{name: "starttls", server: func(f *fakeSMTP) { f.startTLS = true }, security: "starttls", wantTLS: true},
+		{name: "tls", server: func(f *fakeSMTP) { f.implicitTLS = true }, security: "tls", wantTLS: true},
+		{name: "legacy tls flag", server: func(f *fakeSMTP) { f.implicitTLS = true }, legacyTLS: true, wantTLS: true},
+		{name: "opportunistic starttls", server: func(f *fakeSMTP) { f.startTLS = true }, wantTLS: true},
+		{name: "opportunistic without starttls", wantTLS: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSMTP(t, tt.server)
+			s := f.config()
+			s.Security, s.TLS, s.InsecureSkipVerify = tt.security, tt.legacyTLS, true
+			if err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage)); err != nil {
+				t.Fatalf("deliverSMTP: %v", err)
+			}
+			_, _, gotTLS, data := f.result()
+			if gotTLS != tt.wantTLS {
+				t.Errorf("message sent over TLS = %v, want %v", gotTLS, tt.wantTLS)
+			}
+			if !strings.Contains(data, "hello") {
+				t.Errorf("message body not received: %q", data)
+			}
+		})
+	}
+}
+
+func TestDeliverSMTPVerifiesCertificate(t *testing.T) {
+	f := newFakeSMTP(t, func(f *fakeSMTP) { f.startTLS = true })
+	s := f.config()
+	s.Security = "starttls"
+	err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage))
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error without insecure_skip_verify, got %v", err)
+	}
+}
+
+func TestDeliverSMTPStartTLSRequired(t *testing.T) {
+	f := newFakeSMTP(t, nil)
+	s := f.config()
+	s.Security = "starttls"
+	err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage))
+	if err == nil || !strings.Contains(err.Error(), "does not support STARTTLS") {
+		t.Fatalf("expected STARTTLS error, got %v", err)
+	}
+	if _, _, _, data := f.result(); data != "" {
+		t.Error("message must not be sent when STARTTLS is required but not offered")
+	}
+}
+
+func TestDeliverSMTPAuth(t *testing.T) {
+	tests := []struct {
+		auth     string
+		username string
+		password string
+		token    string
+		wantMech string
+		wantErr  string
+	}{
+		{auth: "none", username: fakeSMTPUser, password: fakeSMTPPassword, wantMech: ""},
+		{auth: "", username: fakeSMTPUser, password: fakeSMTPPassword, wantMech: "PLAIN"},
+		{auth: "plain", username: fakeSMTPUser, password: fakeSMTPPassword, wantMech: "PLAIN"},
+		{auth: "login", username: fakeSMTPUser, password: fakeSMTPPassword, wantMech: "LOGIN"},
+		{auth: "cram-md5", username: fakeSMTPUser, password: fakeSMTPPassword, wantMech: "CRAM-MD5"},
+		{auth: "xoauth2", username: fakeSMTPUser, token: fakeSMTPToken, wantMech: "XOAUTH2"},
+		{auth: "xoauth2", username: fakeSMTPUser, password: fakeSMTPToken, wantMech: "XOAUTH2"},
+		{auth: "plain", username: fakeSMTPUser, password: "wrong", wantErr: "535"},
+		{auth: "login", username: fakeSMTPUser, password: "wrong", wantErr: "535"},
+		{auth: "xoauth2", username: fakeSMTPUser, token: "expired", wantErr: "535"},
+		{auth: "digest-md5", username: fakeSMTPUser, wantErr: "unknown smtp.auth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.auth+"/"+tt.password+tt.token, func(t *testing.T) {
+			f := newFakeSMTP(t, func(f *fakeSMTP) { f.startTLS, f.auth = true, true })
+			s := f.config()
+			s.Security, s.InsecureSkipVerify = "starttls", true
+			s.Auth, s.Username, s.Password, s.AccessToken = tt.auth, tt.username, tt.password, tt.token
+			err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("deliverSMTP: %v", err)
+			}
+			mech, user, _, _ := f.result()
+			if mech != tt.wantMech {
+				t.Errorf("auth mechanism = %q, want %q", mech, tt.wantMech)
+			}
+			if tt.wantMech != "" && user != fakeSMTPUser {
+				t.Errorf("authenticated user = %q", user)
+			}
+		})
+	}
+}
+
+// CRAM-MD5 はパスワードを送らないため、暗号化しない接続でも使えます。
+func TestDeliverSMTPCramMD5WithoutTLS(t *testing.T) {
+	f := newFakeSMTP(t, func(f *fakeSMTP) { f.auth = true })
+	s := f.config()
+	s.Security, s.Auth, s.Username, s.Password = "none", "cram-md5", fakeSMTPUser, fakeSMTPPassword
+	if err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("deliverSMTP: %v", err)
+	}
+	if mech, _, _, _ := f.result(); mech != "CRAM-MD5" {
+		t.Errorf("auth mechanism = %q, want CRAM-MD5", mech)
+	}
+}
+
+func TestDeliverSMTPRelayWithoutAuth(t *testing.T) {
+	f := newFakeSMTP(t, nil) // AUTH を広告しないリレー
+	s := f.config()
+	s.Security = "none"
+	if err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("empty username must send without AUTH: %v", err)
+	}
+	if _, _, _, data := f.result(); !strings.Contains(data, "hello") {
+		t.Error("message not received")
+	}
+
+	// 認証方式を明示したのにサーバーが AUTH に対応していなければ送らない
+	s.Auth, s.Username, s.Password = "plain", fakeSMTPUser, fakeSMTPPassword
+	err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage))
+	if err == nil || !strings.Contains(err.Error(), "does not support AUTH") {
+		t.Fatalf("expected AUTH error, got %v", err)
+	}
+}
+
+func TestDeliverSMTPTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		security string
+		dial     int
+		command  int
+	}{
+		// 暗号化しない接続は接続後の挨拶を command_timeout で待つ
+		{name: "command_timeout", security: "none", dial: 30, command: 1},
+		// 接続直後の TLS ハンドシェイクは dial_timeout に含まれる
+		{name: "dial_timeout", security: "tls", dial: 1, command: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSMTP(t, func(f *fakeSMTP) { f.silent = true })
+			s := f.config()
+			s.Security, s.InsecureSkipVerify = tt.security, true
+			s.DialTimeout, s.CommandTimeout = tt.dial, tt.command
+			start := time.Now()
+			err := deliverSMTP(s, s.FromEmail, []string{"to@example.com"}, []byte(testMessage))
+			if err == nil {
+				t.Fatal("expected a timeout error")
+			}
+			var ne net.Error
+			if !(errors.As(err, &ne) && ne.Timeout()) && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected a timeout, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("gave up after %v, want about 1s", elapsed)
+			}
+		})
+	}
+}
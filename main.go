@@ -3,7 +3,6 @@ package main
 import (
 
 	"bytes"
-	"crypto/tls"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -13,13 +12,10 @@ import (
 	"log"
 	"mime"
 	"mime/multipart"
-	"net"
 	"net/http"
-	"net/smtp"
 	"net/textproto"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -61,6 +57,22 @@ type Config struct {
 	JavaScriptInclude []string  `json:"javascript_include"`
 	Log               LogConfig `json:"log"`
 	SMTP SMTPConfig `json:"smtp"`
+	MCP  MCPConfig  `json:"mcp"`
+	Admin AdminConfig `json:"admin"`
+	Auth  AuthConfig  `json:"auth"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	CORS      CORSConfig      `json:"cors"`
+	TrustedProxies  []string `json:"trusted_proxies"`   // 信頼するプロキシの IP / CIDR
+	ClientIPHeaders []string `json:"client_ip_headers"` // 空なら Forwarded, X-Forwarded-For, X-Real-IP
+	IPFilter        IPFilterConfig `json:"ip_filter"`
+	Sandbox         SandboxConfig  `json:"sandbox"`
+	FSRoots         map[string]string `json:"fs_roots"` // スクリプトから参照できるファイルルート（名前 -> ディレクトリ）
+	Exec            ExecConfig        `json:"exec"`
+	Storage         StorageConfig     `json:"storage"`
+	Databases       map[string]DatabaseConfig `json:"databases"` // nyanDB で使う接続（名前 -> 設定）
+	Migrations      MigrationsConfig          `json:"migrations"`
+	Session         SessionConfig             `json:"session"` // nyanSession の Cookie と有効期間
+	CSRF            CSRFConfig                `json:"csrf"`
 }
 
 // LogConfig はログ設定データを表します。
@@ -79,10 +91,12 @@ type NyanResponse struct {
 }
 
 type ExecResult struct {
-	Success  bool   `json:"success"`
-	ExitCode int    `json:"exit_code"`
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
+	Success   bool   `json:"success"`
+	ExitCode  int    `json:"exitCode"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	TimedOut  bool   `json:"timedOut,omitempty"`  // timeoutMs を超えて強制終了した
+	Truncated bool   `json:"truncated,omitempty"` // maxOutputBytes を超えた出力を切り捨てた
 }
 
 type JSONRPCResponse struct {
@@ -114,6 +128,12 @@ type SMTPConfig struct {
 	FromName  string `json:"from_name"`
 	TLS       bool   `json:"tls"`
 	DefaultBCC []string `json:"default_bcc"`
+	Security           string `json:"security"`             // none / starttls / tls（未指定なら tls の値、false ならサーバーが対応していれば STARTTLS）
+	Auth               string `json:"auth"`                 // none / plain / login / cram-md5 / xoauth2（未指定なら username があれば plain）
+	AccessToken        string `json:"access_token"`         // xoauth2 のトークン（環境変数展開可）。未設定なら password
+	DialTimeout        int    `json:"dial_timeout"`         // 接続のタイムアウト（秒）。既定 10
+	CommandTimeout     int    `json:"command_timeout"`      // 各コマンドのタイムアウト（秒）。既定 60
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // 証明書を検証しない（社内リレー向け）
 }
 
 type MailAttachment struct {
@@ -132,7 +152,7 @@ type rpcReq struct {
 
 var (
 	supportedProto = map[string]bool{"2025-06-18": true, "2025-03-26": true}
-	sessions sync.Map // sid -> struct{created time.Time}
+	sessions sync.Map // sid -> *mcpSession
 )
 const defaultProto = "2025-03-26"
 
@@ -141,22 +161,34 @@ const defaultProto = "2025-03-26"
 // config格納場所
 var globalConfig Config
 
-// ストレージ
-var storage sync.Map
-
-// WebSocketアップグレーダー
+// WebSocketアップグレーダー（オリジンは CORS 設定で検証）
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin: checkWebSocketOrigin,
 }
 
 var ginContext *gin.Context
 
 var logger *log.Logger
 
+// コンソール出力先（mcp-stdio モードでは stdout を JSON-RPC 専用にするため stderr）
+var consoleOut io.Writer = os.Stdout
+
 var pushConnections sync.Map
 
+// WebSocket 接続ごとの書き込みロック（push と応答が同時に書き込まないように）
+var wsWriteLocks sync.Map // *websocket.Conn -> *sync.Mutex
+
 // main はメイン関数です。
 func main() {
+	// サブコマンド（nyan8 mcp-stdio）
+	subcommand := ""
+	if len(os.Args) > 1 {
+		subcommand = os.Args[1]
+	}
+	if subcommand == "mcp-stdio" {
+		consoleOut = os.Stderr
+	}
+
 	// 実行ファイルのディレクトリを取得
 	execPath, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -171,14 +203,14 @@ func main() {
 		}
 	}
 	execDir := execPath
-	fmt.Println("Executable directory:", execDir)
+	fmt.Fprintln(consoleOut, "Executable directory:", execDir)
 
 	// 環境変数から設定ファイルのパスを取得する
 	configPath := os.Getenv("CONFIG_PATH")
 	if configPath == "" {
 		configPath = filepath.Join(execDir, "config.json")
 	}
-	fmt.Println("Config file path:", configPath)
+	fmt.Fprintln(consoleOut, "Config file path:", configPath)
 
 	config, err := loadConfig(configPath)
 	if err != nil {
@@ -190,8 +222,93 @@ func main() {
 	// ロガーをセットアップ
 	initLogger(execDir)
 
+	// nyan8 migrate up|down|status（起動中のサーバーと同時に実行できるよう、ストレージは開かない）
+	if subcommand == "migrate" {
+		if err := initDatabases(execDir); err != nil {
+			logger.Fatalf("Failed to initialize databases: %v", err)
+		}
+		err := runMigrateCommand(execDir, os.Args[2:])
+		closeDatabases()
+		if err != nil {
+			logger.Fatalf("Migrate: %v", err)
+		}
+		return
+	}
+
+	// nyanSetItem / nyanGetItem の保存先
+	// mcp-stdio は起動中の HTTP サーバーと bolt のファイルを取り合わないよう、プロセス内の保存先を使う
+	if subcommand == "mcp-stdio" && globalConfig.Storage.Type != "memory" {
+		logger.Printf("Storage: mcp-stdio uses in-memory storage instead of the bolt file")
+	}
+	if err := initStorage(execDir, subcommand == "mcp-stdio"); err != nil {
+		logger.Fatalf("Failed to initialize storage: %v", err)
+	}
+	defer storage.close()
+
+	// nyanDB の接続
+	if err := initDatabases(execDir); err != nil {
+		logger.Fatalf("Failed to initialize databases: %v", err)
+	}
+	defer closeDatabases()
+
+	switch subcommand {
+	case "":
+	case "mcp-stdio":
+		// api.json などの相対パスは config.json のあるディレクトリを基準にする
+		if err := os.Chdir(filepath.Dir(configPath)); err != nil {
+			logger.Fatalf("Failed to change directory: %v", err)
+		}
+		logger.Printf("Starting MCP stdio server")
+		if err := runMCPStdio(os.Stdin, os.Stdout); err != nil {
+			logger.Fatalf("MCP stdio server stopped: %v", err)
+		}
+		return
+	default:
+		logger.Fatalf("Unknown command: %s", subcommand)
+	}
+
+	// nyanSession の Cookie の署名鍵
+	if err := initWebSessions(execDir); err != nil {
+		logger.Fatalf("Failed to initialize sessions: %v", err)
+	}
+
+	// MCP 用 OAuth クライアントの読み込み
+	if err := initMCPOAuth(execDir); err != nil {
+		logger.Fatalf("Failed to initialize MCP OAuth: %v", err)
+	}
+
+	// API 認証（Basic ユーザー / JWKS）の読み込み
+	if err := initAuth(execDir); err != nil {
+		logger.Fatalf("Failed to initialize auth: %v", err)
+	}
+
+	// クライアント IP の判定に使う信頼済みプロキシ
+	if err := initTrustedProxies(); err != nil {
+		logger.Fatalf("Failed to initialize trusted proxies: %v", err)
+	}
+
+	// IP アドレスによるアクセス制限
+	if err := initIPFilters(); err != nil {
+		logger.Fatalf("Failed to initialize IP filter: %v", err)
+	}
+
+	// レート制限の保存先
+	if err := initRateLimit(); err != nil {
+		logger.Fatalf("Failed to initialize rate limit: %v", err)
+	}
+
+	// MCP セッションの復元と期限切れ掃除
+	if err := loadMCPSessions(execDir); err != nil {
+		logger.Printf("Failed to restore MCP sessions: %v", err)
+	}
+	startMCPSessionJanitor()
+
 	r := gin.Default()
-	r.SetTrustedProxies(nil) // 信頼するプロキシの設定を解除
+	// アクセスログの IP も getClientIP と同じプロキシだけを信頼する（未設定なら信頼しない）
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		logger.Fatalf("Invalid trusted_proxies: %v", err)
+	}
+	r.Use(IPFilterMiddleware("global"))
 	r.Use(CORSMiddleware())
 	r.Use(RecoveryMiddleware())
 
@@ -206,15 +323,26 @@ func main() {
 		respondWithError(c, http.StatusNotFound, "Endpoint not found", nil)
 	})
 
-	r.POST("/nyan-rpc", handleJSONRPC)
-	r.POST("/nyan-toolbox", handleMCP)      // JSON-RPC 全メソッド
-	r.GET("/nyan-toolbox", handleMCPGet)     // SSEしない場合は 405
-	r.DELETE("/nyan-toolbox", handleMCPDeleteSession) // 任意: セッション明示終了
+	r.POST("/nyan-rpc", IPFilterMiddleware("rpc"), handleJSONRPC)
+	r.POST("/nyan-toolbox", IPFilterMiddleware("mcp"), MCPOAuthMiddleware(), handleMCP)      // JSON-RPC 全メソッド
+	r.GET("/nyan-toolbox", IPFilterMiddleware("mcp"), MCPOAuthMiddleware(), handleMCPGet)     // SSEしない場合は 405
+	r.DELETE("/nyan-toolbox", IPFilterMiddleware("mcp"), MCPOAuthMiddleware(), handleMCPDeleteSession) // 任意: セッション明示終了
 
-	r.Any("/nyan", handleNyan)
-	r.Any("/nyan/:apiName", handleNyanDetail)
+	// MCP 用 OAuth 2.1（メタデータ・認可・トークン・動的登録）
+	registerMCPOAuthRoutes(r)
+
+	// 管理用エンドポイント
+	registerAdminRoutes(r)
+
+	r.Any("/nyan", IPFilterMiddleware("catalog"), handleNyan)
+	r.Any("/nyan/:apiName", IPFilterMiddleware("catalog"), handleNyanDetail)
 	r.Any("/", handleRequest) // HTTPとWebSocketリクエストを同じエンドポイントで処理
 
+	// 起動時のマイグレーション（migrations.auto）
+	if err := autoMigrate(execDir); err != nil {
+		logger.Fatalf("Failed to run migrations: %v", err)
+	}
+
 	// 動的エンドポイントの登録
 	execDir, _ = os.Getwd() // または、実行ファイルのディレクトリを使用
 	if err := registerDynamicEndpoints(r, execDir); err != nil {
@@ -313,6 +441,42 @@ func resolvePath(baseDir, p string) (string, error) {
 	return filepath.Join(baseDir, p), nil
 }
 
+// getBaseDir は実行ファイルのディレクトリ（一時ディレクトリならカレントディレクトリ）を返します。
+func getBaseDir() string {
+	basePath, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil || isTemporaryDirectory(basePath) {
+		if wd, werr := os.Getwd(); werr == nil {
+			return wd
+		}
+	}
+	return basePath
+}
+
+// writeFileAtomic は一時ファイルに書き込んでからリネームし、途中状態のファイルを残さないようにします。
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 // loadConfig は設定ファイルを読み込みます。
 func loadConfig(filename string) (Config, error) {
 	var config Config
@@ -456,12 +620,24 @@ func handleAPIRequest(c *gin.Context) {
 		return
 	}
 
+	// 認証などの実行前チェック
+	if gerr := guardAPICall(c, scriptValueKey, scriptInfo); gerr != nil {
+		respondGuardError(c, gerr)
+		return
+	}
+	release, gerr := acquireAPISlot(c, scriptValueKey, scriptInfo)
+	if gerr != nil {
+		respondGuardError(c, gerr)
+		return
+	}
+	defer release()
+
 	// 絶対パスに変換（相対なら execDir 起点）
 	// ※ scriptPath は通常相対想定だが、絶対指定も許容できるよう resolvePath を使ってもよい
 	scriptPath = filepath.Join(execDir, scriptPath)
 
 	// JavaScriptを実行し、結果を取得
-	result, err := runJavaScript(scriptPath, allParams, c)
+	result, err := runJavaScript(scriptPath, allParams, c, apiCapabilities(scriptValueKey, scriptInfo))
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, "Failed to run JavaScript", err)
 		return
@@ -487,6 +663,18 @@ func handleAPIRequest(c *gin.Context) {
 
 // handleWebSocket はWebSocketリクエストを処理します。
 func handleWebSocket(c *gin.Context) {
+	// push 受信用の接続も、接続先 API の認証条件を満たす必要がある
+	if wsAPIName := strings.TrimPrefix(c.Request.URL.Path, "/"); wsAPIName != "" {
+		if apiConf, err := loadJSONFile(filepath.Join(getBaseDir(), "api.json")); err == nil {
+			if wsAPIInfo, ok := apiConf[wsAPIName].(map[string]interface{}); ok {
+				if gerr := guardAPICall(c, wsAPIName, wsAPIInfo); gerr != nil {
+					respondGuardError(c, gerr)
+					return
+				}
+			}
+		}
+	}
+
 	// WebSocket 接続をアップグレード
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -495,6 +683,7 @@ func handleWebSocket(c *gin.Context) {
 	}
 	// 接続終了時に登録を解除
 	defer conn.Close()
+	defer wsWriteLocks.Delete(conn)
 
 	// API 名の取得（ルートパラメータがなければ URL から取得）
 	apiName := c.Param("api")
@@ -574,11 +763,27 @@ func handleWebSocket(c *gin.Context) {
 			continue
 		}
 
+		// 認証などの実行前チェック（アップグレード時のリクエストで判定）
+		if gerr := guardAPICall(c, scriptValue, scriptInfo); gerr != nil {
+			sendErrorMessage(conn, gerr.Message)
+			continue
+		}
+		release, gerr := acquireAPISlot(c, scriptValue, scriptInfo)
+		if gerr != nil {
+			sendErrorMessage(conn, gerr.Message)
+			continue
+		}
+
 		// メインAPIのスクリプトの絶対パス作成
 		javascriptPath := filepath.Join(execDir, scriptPath)
 
-		// WebSocket 用なので gin.Context は nil を渡す
-		result, err := runJavaScript(javascriptPath, receivedData, nil)
+		// WebSocket 用なので応答ヘッダーは書けない（Gin は nil、リクエストと認証情報のみ渡す）
+		result, err := runScript(javascriptPath, receivedData, &scriptRequest{
+			Request:   c.Request,
+			Principal: principalFromContext(c),
+			Caps:      apiCapabilities(scriptValue, scriptInfo),
+		})
+		release()
 		if err != nil {
 			logger.Printf("Failed to run JavaScript: %v", err)
 			sendErrorMessage(conn, "Failed to run JavaScript")
@@ -586,7 +791,7 @@ func handleWebSocket(c *gin.Context) {
 		}
 
 		// メインAPIの結果をクライアントへ送信
-		if err := conn.WriteMessage(messageType, []byte(result)); err != nil {
+		if err := writeWSMessage(conn, messageType, []byte(result)); err != nil {
 			logger.Printf("Failed to send message to WebSocket: %v", err)
 			break
 		}
@@ -602,7 +807,7 @@ func handleWebSocket(c *gin.Context) {
 						if ok && pushScript != "" {
 							pushScriptPath := filepath.Join(execDir, pushScript)
 							// push API を実行
-							pushResult, err := runJavaScript(pushScriptPath, receivedData, nil)
+							pushResult, err := runJavaScript(pushScriptPath, receivedData, nil, apiCapabilities(pushTarget, pushConfig))
 							if err != nil {
 								logger.Printf("Push API execution failed for key %s: %v", pushTarget, err)
 							} else {
@@ -611,7 +816,7 @@ func handleWebSocket(c *gin.Context) {
 								// push対象のWebSocket接続があれば、push結果を送信
 								if pushConnRaw, ok := pushConnections.Load(pushTarget); ok {
 									if pushConn, ok := pushConnRaw.(*websocket.Conn); ok {
-										if err := pushConn.WriteMessage(messageType, []byte(pushResult)); err != nil {
+										if err := writeWSMessage(pushConn, messageType, []byte(pushResult)); err != nil {
 											logger.Printf("Failed to push message to %s: %v", pushTarget, err)
 										} else {
 											logger.Printf("Push message sent successfully to %s", pushTarget)
@@ -636,21 +841,72 @@ func handleWebSocket(c *gin.Context) {
 }
 
 // エラーレスポンスの送信
+// writeWSMessage は接続ごとのロックを取ってメッセージを書き込みます。
+func writeWSMessage(conn *websocket.Conn, messageType int, data []byte) error {
+	mu, _ := wsWriteLocks.LoadOrStore(conn, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	return conn.WriteMessage(messageType, data)
+}
+
 func sendErrorMessage(conn *websocket.Conn, message string) {
 	errMessage := map[string]interface{}{
 		"error": message,
 	}
 	jsonMessage, _ := json.Marshal(errMessage)
-	conn.WriteMessage(websocket.TextMessage, jsonMessage)
+	writeWSMessage(conn, websocket.TextMessage, jsonMessage)
+}
+
+// scriptRequest は JS 実行時に参照するリクエスト情報です。
+// WebSocket のメッセージ処理では Gin は nil（応答ヘッダーを書けない）ですが、Request と Principal は参照できます。
+type scriptRequest struct {
+	Gin       *gin.Context
+	Request   *http.Request
+	Principal *Principal
+	Caps      *capabilitySet // api.json の allow で許可された機能
+
+	finishers []func() // スクリプトの終了時に実行する後始末
+}
+
+// onFinish はスクリプトの終了時（例外で終わった場合も含む）に実行する処理を登録します。
+func (sr *scriptRequest) onFinish(fn func()) {
+	sr.finishers = append(sr.finishers, fn)
+}
+
+func (sr *scriptRequest) finish() {
+	for i := len(sr.finishers) - 1; i >= 0; i-- {
+		sr.finishers[i]()
+	}
+	sr.finishers = nil
+}
+
+// newScriptRequest は gin.Context からリクエスト情報を作ります（nil なら空）。
+func newScriptRequest(ginCtx *gin.Context, caps *capabilitySet) *scriptRequest {
+	if ginCtx == nil {
+		return &scriptRequest{Caps: caps}
+	}
+	return &scriptRequest{
+		Gin:       ginCtx,
+		Request:   ginCtx.Request,
+		Principal: principalFromContext(ginCtx),
+		Caps:      caps,
+	}
 }
 
 // runJavaScript はJavaScriptを実行します。
 // runJavaScript は、指定された JavaScript コードを goja で実行します。
-func runJavaScript(scriptPath string, allParams map[string]interface{}, ginCtx *gin.Context) (string, error) {
+// caps は apiCapabilities で作った、スクリプトに許可する機能です。
+func runJavaScript(scriptPath string, allParams map[string]interface{}, ginCtx *gin.Context, caps *capabilitySet) (string, error) {
+	return runScript(scriptPath, allParams, newScriptRequest(ginCtx, caps))
+}
+
+// runScript は scriptRequest を指定して JavaScript を実行します。
+func runScript(scriptPath string, allParams map[string]interface{}, sr *scriptRequest) (string, error) {
 	// 新たな goja の VM を生成
 	vm := goja.New()
 	// 必要なグローバル関数等を登録する
-	setupGojaVM(vm, ginCtx)
+	setupGojaVM(vm, sr)
+	defer sr.finish()
 
 	// ★★★ 追加：include の基準ディレクトリを取得（mainと同じロジック） ★★★
 	basePath, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -720,24 +976,7 @@ func loadJSONFile(filePath string) (map[string]interface{}, error) {
 	return jsonData, nil
 }
 
-func CORSMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	}
-}
-
-func getAPI(url, username, password string) (string, error) {
-	// HTTPクライアントの生成
-	client := &http.Client{}
+func getAPI(client *http.Client, url, username, password string) (string, error) {
 
 	// リクエストの生成
 	req, err := http.NewRequest("GET", url, nil)
@@ -766,7 +1005,7 @@ func getAPI(url, username, password string) (string, error) {
 }
 
 // POSTリクエストを行うGo関数
-func jsonAPI(url string, jsonData []byte, username, password string, headers map[string]string) (string, error) {
+func jsonAPI(client *http.Client, url string, jsonData []byte, username, password string, headers map[string]string) (string, error) {
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", err
@@ -788,7 +1027,6 @@ func jsonAPI(url string, jsonData []byte, username, password string, headers map
 		}
 	}
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -816,7 +1054,7 @@ func initLogger(execDir string) {
 		}, "", log.LstdFlags)
 	} else {
 		// EnableLogging が false の場合はコンソール出力
-		logger = log.New(os.Stdout, "", log.LstdFlags)
+		logger = log.New(consoleOut, "", log.LstdFlags)
 	}
 }
 
@@ -862,6 +1100,8 @@ func registerDynamicEndpoints(r *gin.Engine, execDir string) error {
 		"nyan":         {},
 		"nyan-rpc":     {},
 		"nyan-toolbox": {},
+		"oauth":        {},
+		".well-known":  {},
 	}
 
 	for apiName := range apiConf {
@@ -925,9 +1165,21 @@ func registerDynamicEndpoints(r *gin.Engine, execDir string) error {
 				return
 			}
 
+			// 認証などの実行前チェック
+			if gerr := guardAPICall(c, endpoint, scriptInfo); gerr != nil {
+				respondGuardError(c, gerr)
+				return
+			}
+			release, gerr := acquireAPISlot(c, endpoint, scriptInfo)
+			if gerr != nil {
+				respondGuardError(c, gerr)
+				return
+			}
+			defer release()
+
 			// 実行
 			fullScriptPath := filepath.Join(execDir, scriptPath)
-			result, err := runJavaScript(fullScriptPath, allParams, c)
+			result, err := runJavaScript(fullScriptPath, allParams, c, apiCapabilities(endpoint, scriptInfo))
 			if err != nil {
 				respondWithError(c, http.StatusInternalServerError, "Failed to run JavaScript", err)
 				return
@@ -967,7 +1219,7 @@ func performPush(scriptInfo map[string]interface{}, scriptListData map[string]in
 					if ok && pushScript != "" {
 						pushScriptPath := filepath.Join(execDir, pushScript)
 						// push 対象の API のスクリプトを実行
-						pushResult, err := runJavaScript(pushScriptPath, allParams, nil)
+						pushResult, err := runJavaScript(pushScriptPath, allParams, nil, apiCapabilities(pushTarget, pushConfig))
 						if err != nil {
 							logger.Printf("Push API execution failed for key %s: %v", pushTarget, err)
 						} else {
@@ -978,7 +1230,7 @@ func performPush(scriptInfo map[string]interface{}, scriptListData map[string]in
 									pushMessage := []byte(pushResult)
 
 									logger.Printf("Sending push message: %s", string(pushMessage))
-									if err := pushConn.WriteMessage(websocket.TextMessage, pushMessage); err != nil {
+									if err := writeWSMessage(pushConn, websocket.TextMessage, pushMessage); err != nil {
 										logger.Printf("Failed to push message to %s: %v", pushTarget, err)
 									} else {
 										logger.Printf("Push message sent successfully to %s", pushTarget)
@@ -1001,8 +1253,16 @@ func performPush(scriptInfo map[string]interface{}, scriptListData map[string]in
 	}
 }
 
+// nyanCatalogFields は /nyan の一覧に載せる api.json の項目です。
+var nyanCatalogFields = []string{"title", "description", "push", "annotations", "outputSchema"}
+
 // handleNyan は /nyan エンドポイントを処理します。
 func handleNyan(c *gin.Context) {
+	// handleRequest の ?api=nyan からも呼ばれるため、ルートとは別に catalog の制限を確認する
+	if rejectByIPFilter(c, "catalog") {
+		return
+	}
+
 	// 作業ディレクトリの取得
 	execDir, err := os.Getwd()
 	if err != nil {
@@ -1018,12 +1278,21 @@ func handleNyan(c *gin.Context) {
 		return
 	}
 
-	// 各API設定から "script" キーを削除する（スクリプトパスは見せない）
+	// 公開してよい項目だけを返す（スクリプトのパスや allow・auth などのサーバー側の設定は見せない）
+	// 呼び出し元の IP から利用できない API は一覧に含めない
 	for key, api := range apiConf {
-		if apiMap, ok := api.(map[string]interface{}); ok {
-			delete(apiMap, "script")
-			apiConf[key] = apiMap
+		apiMap, ok := api.(map[string]interface{})
+		if !ok || !apiIPAllowed(c, apiMap) {
+			delete(apiConf, key)
+			continue
+		}
+		public := map[string]interface{}{}
+		for _, k := range nyanCatalogFields {
+			if v, ok := apiMap[k]; ok {
+				public[k] = v
+			}
 		}
+		apiConf[key] = public
 	}
 
 	// config.json の値は globalConfig に保持されている想定
@@ -1077,6 +1346,10 @@ func handleNyanDetail(c *gin.Context) {
 		respondWithError(c, http.StatusInternalServerError, "Invalid API data format in api.json", nil)
 		return
 	}
+	if !apiIPAllowed(c, apiData) {
+		respondWithError(c, http.StatusNotFound, fmt.Sprintf("API not found: %s", apiName), nil)
+		return
+	}
 
 	// api.json に記載された description を取得（なければ空文字）
 	description, _ := apiData["description"].(string)
@@ -1150,51 +1423,39 @@ func parseConstArray(scriptContent []byte, constName string) []interface{} {
 }
 
 // gojaのVMのセットアップ
-func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
+func setupGojaVM(vm *goja.Runtime, sr *scriptRequest) {
+	ginCtx := sr.Gin
 
-	vm.Set("nyanGetAPI", func(call goja.FunctionCall) goja.Value {
+	// 認証済みの呼び出し元（未認証なら null）
+	vm.Set("nyanAuth", principalJSValue(sr.Principal))
+
+	setCapabilityBinding(vm, sr, "http", "nyanGetAPI", func(call goja.FunctionCall) goja.Value {
 		url := call.Argument(0).String()
 		user := call.Argument(1).String()
 		pass := call.Argument(2).String()
-		result, err := getAPI(url, user, pass)
+		sr.Caps.require(vm, sr, "http", url)
+		result, err := getAPI(sr.Caps.httpClient(sr), url, user, pass)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
 		return vm.ToValue(result)
 	})
 
-	vm.Set("nyanGetCookie", func(name string) string {
-		if ginCtx == nil {
-			return ""
-		}
-		v, _ := ginCtx.Cookie(name)
-		return v
-	})
-	vm.Set("nyanSetCookie", func(name, value string) {
-		if ginCtx != nil {
-			ginCtx.SetCookie(name, value, 3600, "/", "", false, true)
-		}
-	})
+	setupCookieBindings(vm, sr)
 
-	vm.Set("nyanSetItem", func(k, v string) { storage.Store(k, v) })
-	vm.Set("nyanGetItem", func(k string) string {
-		if v, ok := storage.Load(k); ok {
-			if s, ok := v.(string); ok {
-				return s
-			}
-		}
-		return ""
-	})
+	setupStorageBindings(vm, sr)
+	setupSessionBindings(vm, sr)
 
 	vm.Set("console", map[string]interface{}{
 		"log": func(args ...interface{}) { logger.Print(args...) },
 	})
 
-	vm.Set("nyanJsonAPI", func(call goja.FunctionCall) goja.Value {
+	setCapabilityBinding(vm, sr, "http", "nyanJsonAPI", func(call goja.FunctionCall) goja.Value {
 		url := call.Argument(0).String()
 		data := call.Argument(1).String()
 		user := call.Argument(2).String()
 		pass := call.Argument(3).String()
+		sr.Caps.require(vm, sr, "http", url)
 
 		var hdr map[string]string
 		if len(call.Arguments) >= 5 {
@@ -1205,20 +1466,42 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 				}
 			}
 		}
-		res, err := jsonAPI(url, []byte(data), user, pass, hdr)
+		res, err := jsonAPI(sr.Caps.httpClient(sr), url, []byte(data), user, pass, hdr)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
 		return vm.ToValue(res)
 	})
 
-	vm.Set("nyanHostExec", func(call goja.FunctionCall) goja.Value {
+	setCapabilityBinding(vm, sr, "exec", "nyanHostExec", func(call goja.FunctionCall) goja.Value {
 		if len(call.Arguments) == 0 {
 			panic(vm.ToValue("command required"))
 		}
-		cmd := call.Argument(0).String()
-		out, err := execCommand(cmd)
-		if err != nil {
+		var out *ExecResult
+		var err error
+		if obj, ok := call.Argument(0).Export().(map[string]interface{}); ok {
+			// オブジェクト形式: シェルを介さずに実行
+			opts, perr := parseExecOptions(obj)
+			if perr != nil {
+				panic(vm.ToValue(perr.Error()))
+			}
+			// exec:<コマンド名> と exec:<絶対パス> のどちらで許可してもよい
+			target := opts.Path
+			if sr.Caps.allows("exec", opts.Cmd) {
+				target = opts.Cmd
+			}
+			sr.Caps.require(vm, sr, "exec", target)
+			out, err = runHostExec(opts)
+		} else {
+			cmd := call.Argument(0).String()
+			if perr := checkShellExecAllowed(); perr != nil {
+				panic(vm.ToValue(perr.Error()))
+			}
+			sr.Caps.require(vm, sr, "exec", execProgram(cmd))
+			out, err = execCommand(cmd)
+		}
+		if err != nil && out == nil {
+			// 起動できなかった場合だけ例外（終了コードが 0 以外なら exitCode で返す）
 			panic(vm.ToValue(err.Error()))
 		}
 		js, _ := json.Marshal(out)
@@ -1227,7 +1510,10 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 		return vm.ToValue(m)
 	})
 
-	vm.Set("nyanGetFile", newNyanGetFile(vm))
+	setupSpawnBindings(vm, sr)
+	setupDatabaseBindings(vm, sr)
+
+	setCapabilityBinding(vm, sr, "fs:read", "nyanGetFile", newNyanGetFile(vm, sr))
 
 	/* ===============================================================
 	   nyanSendMail
@@ -1235,7 +1521,7 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 	   - 旧シグネチャ呼び出し  (to,subject,body[,html][,cc][,bcc])
 	================================================================ */
 
-	vm.Set("nyanSendMail", func(call goja.FunctionCall) goja.Value {
+	setCapabilityBinding(vm, sr, "mail", "nyanSendMail", func(call goja.FunctionCall) goja.Value {
 
 		// ---- ヘルパー：任意 → []string --------------------------------
 		toSlice := func(v interface{}) []string {
@@ -1291,11 +1577,11 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 					if pv, ok := m["path"]; ok {
 						p := fmt.Sprint(pv)
 						if p != "" {
-							abs := p
-							if !filepath.IsAbs(p) {
-								wd, _ := os.Getwd()
-								abs = filepath.Join(wd, p)
+							abs, err := resolveScriptPath(p)
+							if err != nil {
+								panic(vm.ToValue("read attach: " + err.Error()))
 							}
+							sr.Caps.require(vm, sr, "fs:read", abs)
 							data, err := os.ReadFile(abs)
 							if err != nil {
 								panic(vm.ToValue("read attach: " + err.Error()))
@@ -1322,6 +1608,7 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 				}
 			}
 
+			sr.Caps.require(vm, sr, "mail", "")
 			if err := sendMail(to, cc, bcc, subj, body, html, atts); err != nil {
 				panic(vm.ToValue(err.Error()))
 			}
@@ -1348,6 +1635,7 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 			bcc = toSlice(call.Argument(5).Export())
 		}
 
+		sr.Caps.require(vm, sr, "mail", "")
 		if err := sendMail(to, cc, bcc, subj, body, html, nil); err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
@@ -1356,13 +1644,13 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 
 
 	// --- base64--------------------------------------
-	vm.Set("nyanReadFileB64", func(path string) string {
-		// 相対パスならカレントディレクトリ基準で解決
-		abs := path
-		if !filepath.IsAbs(path) {
-			wd, _ := os.Getwd()
-			abs = filepath.Join(wd, path)
+	setCapabilityBinding(vm, sr, "fs:read", "nyanReadFileB64", func(path string) string {
+		// ファイルルート（fs_roots）の中で解決
+		abs, err := resolveScriptPath(path)
+		if err != nil {
+			panic(vm.ToValue(err.Error()))
 		}
+		sr.Caps.require(vm, sr, "fs:read", abs)
 
 		data, err := os.ReadFile(abs)
 		if err != nil {
@@ -1372,12 +1660,12 @@ func setupGojaVM(vm *goja.Runtime, ginCtx *gin.Context) {
 		return base64.StdEncoding.EncodeToString(data) // 改行無し／バイナリ OK
 	})
 	// --------------------------------------------------------------
-	vm.Set("nyanSendMailAttachment", func(path string) map[string]interface{} {
-		abs := path
-		if !filepath.IsAbs(path) {
-			wd, _ := os.Getwd()
-			abs = filepath.Join(wd, path)
+	setCapabilityBinding(vm, sr, "fs:read", "nyanSendMailAttachment", func(path string) map[string]interface{} {
+		abs, err := resolveScriptPath(path)
+		if err != nil {
+			panic(vm.ToValue(err.Error()))
 		}
+		sr.Caps.require(vm, sr, "fs:read", abs)
 		data, err := os.ReadFile(abs)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
@@ -1441,67 +1729,7 @@ func convertShiftJISToUTF8(b []byte) (string, error) {
 	return string(converted), nil
 }
 
-// execCommand は、指定されたコマンドを実行し、結果を返す
-func execCommand(commandLine string) (*ExecResult, error) {
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("cmd", "/C", commandLine)
-	} else {
-		cmd = exec.Command("sh", "-c", commandLine)
-	}
-
-	var stdoutBuf bytes.Buffer
-	var stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
-
-	err := cmd.Run()
-
-	result := &ExecResult{
-		Success:  false,
-		ExitCode: 0,
-		Stdout:   "",
-		Stderr:   "",
-	}
-
-	// (1) WindowsならShift-JIS→UTF-8変換を試みる
-	//     それ以外のOSなら、そのままUTF-8として扱う
-	if runtime.GOOS == "windows" {
-		// stdout
-		utf8Str, convErr := convertShiftJISToUTF8(stdoutBuf.Bytes())
-		if convErr != nil {
-			utf8Str = stdoutBuf.String() // フォールバック（変換失敗時は生バイトを流用）
-		}
-		result.Stdout = utf8Str
-
-		// stderr
-		utf8ErrStr, convErr2 := convertShiftJISToUTF8(stderrBuf.Bytes())
-		if convErr2 != nil {
-			utf8ErrStr = stderrBuf.String()
-		}
-		result.Stderr = utf8ErrStr
-	} else {
-		// Linux, macOSなどはそのままUTF-8扱い
-		result.Stdout = stdoutBuf.String()
-		result.Stderr = stderrBuf.String()
-	}
-
-	if err != nil {
-		// 終了コードを取得
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			result.ExitCode = exitErr.ExitCode()
-		} else {
-			result.ExitCode = -1
-		}
-
-		return result, fmt.Errorf("failed to exec: %w", err)
-	}
-
-	result.Success = true
-	return result, nil
-}
-
-func newNyanGetFile(vm *goja.Runtime) func(call goja.FunctionCall) goja.Value {
+func newNyanGetFile(vm *goja.Runtime, sr *scriptRequest) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
 		// 引数のチェック
 		if len(call.Arguments) < 1 {
@@ -1509,13 +1737,12 @@ func newNyanGetFile(vm *goja.Runtime) func(call goja.FunctionCall) goja.Value {
 		}
 		relativePath := call.Arguments[0].String()
 
-		// 実行中のバイナリのディレクトリからの相対パスに解決
-		exePath, err := os.Executable()
+		// ファイルルート（fs_roots、未設定なら実行ディレクトリ）の中で解決
+		fullPath, err := resolveScriptPath(relativePath)
 		if err != nil {
 			panic(vm.ToValue(err.Error()))
 		}
-		exeDir := filepath.Dir(exePath)
-		fullPath := filepath.Join(exeDir, relativePath)
+		sr.Caps.require(vm, sr, "fs:read", fullPath)
 
 		// ディレクトリ指定なら null
 		if fi, err := os.Stat(fullPath); err == nil && fi.IsDir() {
@@ -1626,6 +1853,18 @@ func handleJSONRPC(c *gin.Context) {
 	scriptPath, _ := scriptPathRaw.(string)
 	fullPath := filepath.Join(execDir, scriptPath)
 
+	// 認証などの実行前チェック（HTTP エンドポイントと同じ条件）
+	if gerr := guardAPICall(c, rpcReq.Method, scriptInfo); gerr != nil {
+		respondJSONRPCGuardError(c, rpcReq.ID, gerr)
+		return
+	}
+	release, gerr := acquireAPISlot(c, rpcReq.Method, scriptInfo)
+	if gerr != nil {
+		respondJSONRPCGuardError(c, rpcReq.ID, gerr)
+		return
+	}
+	defer release()
+
 	// JSON-RPCのparamsを元にパラメータマップを構築
 	allParams := make(map[string]interface{})
 	for k, v := range rpcReq.Params {
@@ -1635,7 +1874,7 @@ func handleJSONRPC(c *gin.Context) {
 	allParams["api"] = rpcReq.Method
 
 	// JavaScriptの実行
-	resultStr, err := runJavaScript(fullPath, allParams, c)
+	resultStr, err := runJavaScript(fullPath, allParams, c, apiCapabilities(rpcReq.Method, scriptInfo))
 	if err != nil {
 		respondJSONRPCError(c, rpcReq.ID, -32603, "Script execution failed", err)
 		return
@@ -1817,71 +2056,7 @@ func sendMail(
 
 	/* ───── 4. SMTP 送信 ────────────────────────── */
 	rcpts := append(append(to, cc...), bcc...)
-	addr  := fmt.Sprintf("%s:%d", s.Host, s.Port)
-	auth  := smtp.PlainAuth("", s.Username, s.Password, s.Host)
-
-	// 4-1 SMTPS / STARTTLS 直後 TLS
-	if s.TLS {
-		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: s.Host})
-		if err != nil {
-			return err
-		}
-		c, err := smtp.NewClient(conn, s.Host)
-		if err != nil {
-			return err
-		}
-		defer c.Quit()
-
-		if err := c.Auth(auth); err != nil {
-			return err
-		}
-		if err := c.Mail(s.FromEmail); err != nil {
-			return err
-		}
-		for _, r := range rcpts {
-			if err := c.Rcpt(r); err != nil {
-				return err
-			}
-		}
-		w, _ := c.Data()
-		if _, err := w.Write(msg.Bytes()); err != nil {
-			return err
-		}
-		return w.Close()
-	}
-
-	// 4-2 平文 or STARTTLS をサーバ側が自動要求
-	return smtp.SendMail(addr, auth, s.FromEmail, rcpts, msg.Bytes())
-}
-
-func getClientIP(r *http.Request) string {
-	if r == nil {
-		return ""
-	}
-
-	// X-Forwarded-For（カンマ区切りで複数入ることがある）
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		for _, p := range parts {
-			ip := strings.TrimSpace(p)
-			if ip != "" && ip != "unknown" {
-				return ip
-			}
-		}
-	}
-
-	// X-Real-IP
-	if xr := strings.TrimSpace(r.Header.Get("X-Real-IP")); xr != "" {
-		return xr
-	}
-
-	// RemoteAddr のパース（host:port）
-	if host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr)); err == nil && host != "" {
-		return host
-	}
-
-	// フォールバック
-	return r.RemoteAddr
+	return deliverSMTP(s, s.FromEmail, rcpts, msg.Bytes())
 }
 
 func handleMCP(c *gin.Context) {
@@ -1895,33 +2070,25 @@ func handleMCP(c *gin.Context) {
 	// initialize は特別扱い（セッション開始 & プロトコル合意）
 	switch req.Method {
 	case "initialize":
-		// params.protocolVersion を読む
-		var p struct {
-			ProtocolVersion string         `json:"protocolVersion"`
-			Capabilities    map[string]any `json:"capabilities"`
-			ClientInfo      map[string]any `json:"clientInfo"`
-		}
-		_ = json.Unmarshal(req.Params, &p)
-
-		ver := p.ProtocolVersion
-		if !supportedProto[ver] { ver = defaultProto } // 最低限の互換を返す
+		res, ver, clientInfo, clientCaps := mcpInitialize(req.Params)
 
 		// セッション発行（任意だが推奨）
-		sid := generateSecureSessionID()
-		sessions.Store(sid, time.Now())
-		c.Header("Mcp-Session-Id", sid)
-
-		// サーバの capabilities（最低限 tools）
-		res := map[string]any{
-			"protocolVersion": ver,
-			"capabilities": map[string]any{
-				"tools": map[string]any{"listChanged": false},
-			},
-			"serverInfo": map[string]string{
-				"name":    globalConfig.Name,
-				"version": globalConfig.Version,
-			},
+		sess := &mcpSession{
+			ProtocolVersion:    ver,
+			ClientInfo:         clientInfo,
+			ClientCapabilities: clientCaps,
+			Subject:            mcpSubject(c),
+			RemoteIP:           getClientIP(c.Request),
+		}
+		if err := createMCPSession(sess); err != nil {
+			c.JSON(http.StatusServiceUnavailable, map[string]any{
+				"jsonrpc":"2.0","id":req.ID,
+				"error": map[string]any{"code":-32000,"message":err.Error()},
+			})
+			return
 		}
+		c.Header("Mcp-Session-Id", sess.ID)
+
 		c.JSON(http.StatusOK, map[string]any{
 			"jsonrpc":"2.0","id":req.ID,"result":res,
 		})
@@ -1937,26 +2104,35 @@ func handleMCP(c *gin.Context) {
 	}
 
 	// initialize 以外はセッションとプロトコルヘッダを検証
-	sid := c.GetHeader("Mcp-Session-Id")
-	if _, ok := sessions.Load(sid); !ok {
+	sess := lookupMCPSession(c.GetHeader("Mcp-Session-Id"))
+	if sess == nil || sess.Subject != mcpSubject(c) {
 		c.AbortWithStatus(http.StatusNotFound) // 404 → クライアントは再 initialize
 		return
 	}
+	sess.touch()
 	proto := c.GetHeader("MCP-Protocol-Version")
-	if proto == "" { proto = defaultProto }
+	if proto == "" { proto = sess.ProtocolVersion }
 	if !supportedProto[proto] {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
+	// メソッドの処理は HTTP / stdio で共通
+	result, rpcErr := dispatchMCPMethod(c, req)
+	writeMCPResult(c, req.ID, result, rpcErr)
+}
+
+// dispatchMCPMethod は initialize 以降の MCP メソッドを処理します。
+// stdio モードでは c は nil です。
+func dispatchMCPMethod(c *gin.Context, req rpcReq) (any, *JSONRPCError) {
 	switch req.Method {
 	case "tools/list":
 		// api.json → Tool 定義（inputSchema は camelCase）
-		result := buildToolsList() // []Tool と nextCursor を返す自前関数
-		c.JSON(http.StatusOK, map[string]any{
-			"jsonrpc":"2.0","id":req.ID,"result":result,
-		})
-		return
+		var p struct {
+			Cursor string `json:"cursor"`
+		}
+		_ = json.Unmarshal(req.Params, &p)
+		return buildToolsList(c, p.Cursor) // []Tool と nextCursor を返す自前関数
 
 	case "tools/call":
 		var p struct {
@@ -1966,23 +2142,57 @@ func handleMCP(c *gin.Context) {
 		_ = json.Unmarshal(req.Params, &p)
 		// JS 実行
 		out := callJS(p.Name, p.Arguments, c) // 既存 runJavaScript をラップして取得
-		// MCP 形式の結果に整形（最低限 text）
-		c.JSON(http.StatusOK, map[string]any{
-			"jsonrpc":"2.0","id":req.ID,"result": map[string]any{
-				"content": []map[string]any{{"type":"text","text": stringOrJSON(out)}},
-			},
-		})
-		return
+		// MCP 形式の結果に整形（text / structuredContent / isError）
+		return buildToolCallResult(out), nil
+
+	case "resources/list":
+		return mcpResourcesList(c)
+
+	case "resources/templates/list":
+		return mcpResourceTemplatesList()
+
+	case "resources/read":
+		return mcpResourcesRead(c, req.Params)
+
+	case "prompts/list":
+		return mcpPromptsList()
+
+	case "prompts/get":
+		return mcpPromptsGet(req.Params)
+
+	case "ping":
+		return map[string]any{}, nil
 
 	default:
-		c.JSON(http.StatusOK, map[string]any{
-			"jsonrpc":"2.0","id":req.ID,
-			"error": map[string]any{"code":-32601,"message":"Method not found"},
-		})
-		return
+		return nil, &JSONRPCError{Code: -32601, Message: "Method not found"}
 	}
 }
 
+// mcpInitialize は initialize の params からプロトコルバージョンを合意し、結果を返します。
+func mcpInitialize(params json.RawMessage) (result map[string]any, ver string, clientInfo, clientCaps map[string]any) {
+	// params.protocolVersion を読む
+	var p struct {
+		ProtocolVersion string         `json:"protocolVersion"`
+		Capabilities    map[string]any `json:"capabilities"`
+		ClientInfo      map[string]any `json:"clientInfo"`
+	}
+	_ = json.Unmarshal(params, &p)
+
+	ver = p.ProtocolVersion
+	if !supportedProto[ver] { ver = defaultProto } // 最低限の互換を返す
+
+	// サーバの capabilities（tools と、設定があれば resources / prompts）
+	result = map[string]any{
+		"protocolVersion": ver,
+		"capabilities":    mcpCapabilities(),
+		"serverInfo": map[string]string{
+			"name":    globalConfig.Name,
+			"version": globalConfig.Version,
+		},
+	}
+	return result, ver, p.ClientInfo, p.Capabilities
+}
+
 func handleMCPGet(c *gin.Context) {
 	c.AbortWithStatus(http.StatusMethodNotAllowed) // 405
 }
@@ -1998,11 +2208,17 @@ func generateSecureSessionID() string {
 	return base64.RawURLEncoding.EncodeToString(b) // パディング無し
 }
 
-// セッションTTL（必要に応じて利用）
+// セッションTTLの既定値（mcp.session.ttl で変更可能）
 const sessionTTL = 24 * time.Hour
 
-func isSessionAlive(created time.Time) bool {
-	return time.Since(created) < sessionTTL
+// isSessionAlive は作成からの TTL と無操作タイムアウトの両方を判定します。
+func isSessionAlive(s *mcpSession) bool {
+	snap := s.snapshot()
+	if time.Since(snap.Created) >= mcpSessionTTL() {
+		return false
+	}
+	idle := globalConfig.MCP.Session.IdleTimeout
+	return idle <= 0 || time.Since(snap.LastActivity) < time.Duration(idle)*time.Second
 }
 
 // DELETE /nyan-toolbox でセッション明示終了
@@ -2012,8 +2228,9 @@ func handleMCPDeleteSession(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	if _, ok := sessions.Load(sid); ok {
-		sessions.Delete(sid)
+	if sess := lookupMCPSession(sid); sess != nil && sess.Subject == mcpSubject(c) {
+		deleteMCPSession(sid)
+		saveMCPSessionsAsync()
 		c.Status(http.StatusNoContent) // 204
 		return
 	}
@@ -2021,23 +2238,38 @@ func handleMCPDeleteSession(c *gin.Context) {
 }
 
 // tools/list の結果を api.json から構築（MCP 形式）
-func buildToolsList() map[string]any {
+// cursor は前ページ最後のツール名を符号化したもので、ツール名順にページ分割する
+func buildToolsList(c *gin.Context, cursor string) (map[string]any, *JSONRPCError) {
 	execDir, err := os.Getwd()
 	if err != nil {
-		return map[string]any{"tools": []any{}, "nextCursor": nil}
+		return map[string]any{"tools": []any{}}, nil
 	}
 	apiConfPath := filepath.Join(execDir, "api.json")
 	apiConf, err := loadJSONFile(apiConfPath)
 	if err != nil {
-		return map[string]any{"tools": []any{}, "nextCursor": nil}
+		return map[string]any{"tools": []any{}}, nil
 	}
 
+	after, err := decodeToolsCursor(cursor)
+	if err != nil {
+		return nil, &JSONRPCError{Code: -32602, Message: "Invalid cursor"}
+	}
+	pageSize := mcpToolsPageSize()
+
 	tools := make([]map[string]any, 0, len(apiConf))
-	for name, raw := range apiConf {
-		api, ok := raw.(map[string]any)
-		if !ok {
+	nextCursor := ""
+	for _, name := range sortedToolNames(apiConf) {
+		if name <= after && after != "" {
+			continue
+		}
+		api, ok := apiConf[name].(map[string]any)
+		if !ok || !mcpToolExposed(api) || !apiIPAllowed(c, api) {
 			continue
 		}
+		if len(tools) >= pageSize {
+			nextCursor = encodeToolsCursor(tools[len(tools)-1]["name"].(string))
+			break
+		}
 		desc, _ := api["description"].(string)
 		scriptPath, _ := api["script"].(string)
 
@@ -2076,43 +2308,73 @@ func buildToolsList() map[string]any {
 			}
 		}
 
-		tools = append(tools, map[string]any{
+		tool := map[string]any{
 			"name":        name,
 			"description": desc,
 			"inputSchema": inputSchema, // MCP は camelCase
-		})
+		}
+		// 表示名とヒント（api.json の title / annotations）
+		if title, ok := api["title"].(string); ok && title != "" {
+			tool["title"] = title
+		}
+		if annotations := mcpToolAnnotations(api); len(annotations) > 0 {
+			tool["annotations"] = annotations
+		}
+		// 構造化出力のスキーマ（api.json の outputSchema）
+		if outputSchema, ok := api["outputSchema"].(map[string]any); ok {
+			tool["outputSchema"] = outputSchema
+		}
+		tools = append(tools, tool)
 	}
 
-	return map[string]any{
-		"tools":      tools,
-		"nextCursor": nil,
+	result := map[string]any{"tools": tools}
+	if nextCursor != "" {
+		result["nextCursor"] = nextCursor
 	}
+	return result, nil
 }
 
 // tools/call 用: JS 呼び出しの薄いラッパ
 func callJS(toolName string, args map[string]any, c *gin.Context) string {
-	execDir, err := os.Getwd()
+	execDir, err := mcpBaseDir()
 	if err != nil {
-		return `{"status":500,"error":"cwd error"}`
+		return toolErrorJSON(500, "cwd error")
 	}
 	apiConfPath := filepath.Join(execDir, "api.json")
 	apiConf, err := loadJSONFile(apiConfPath)
 	if err != nil {
-		return `{"status":500,"error":"api.json load error"}`
+		return toolErrorJSON(500, "api.json load error")
 	}
 
 	raw, ok := apiConf[toolName]
 	if !ok {
-		return fmt.Sprintf(`{"status":404,"error":"tool not found: %s"}`, toolName)
+		return toolErrorJSON(404, "tool not found: "+toolName)
 	}
 	api, ok := raw.(map[string]any)
 	if !ok {
-		return `{"status":500,"error":"invalid api config"}`
+		return toolErrorJSON(500, "invalid api config")
+	}
+	// mcp: false の API はツールとして呼び出させない
+	if !mcpToolExposed(api) {
+		return toolErrorJSON(404, "tool not found: "+toolName)
 	}
 	scriptPath, _ := api["script"].(string)
 	if scriptPath == "" {
-		return `{"status":400,"error":"no script path"}`
+		return toolErrorJSON(400, "no script path")
+	}
+
+	// 認証などの実行前チェック（HTTP エンドポイントと同じ条件）
+	if gerr := guardAPICall(c, toolName, api); gerr != nil {
+		for k, v := range gerr.Headers {
+			c.Header(k, v) // Retry-After などは HTTP 応答にも載せる
+		}
+		return toolErrorJSON(gerr.Status, gerr.Message)
+	}
+	release, gerr := acquireAPISlot(c, toolName, api)
+	if gerr != nil {
+		return toolErrorJSON(gerr.Status, gerr.Message)
 	}
+	defer release()
 
 	fullScript := filepath.Join(execDir, scriptPath)
 
@@ -2132,9 +2394,9 @@ func callJS(toolName string, args map[string]any, c *gin.Context) string {
 		allParams["_headers"] = h
 	}
 
-	out, err := runJavaScript(fullScript, allParams, c)
+	out, err := runJavaScript(fullScript, allParams, c, apiCapabilities(toolName, api))
 	if err != nil {
-		return fmt.Sprintf(`{"status":500,"error":%q}`, err.Error())
+		return toolErrorJSON(500, err.Error())
 	}
 	return out
 }
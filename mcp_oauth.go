@@ -0,0 +1,856 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MCPConfig は MCP サーバ（/nyan-toolbox）の設定データを表します。
+type MCPConfig struct {
+	OAuth     MCPOAuthConfig             `json:"oauth"`
+	Session   MCPSessionConfig           `json:"session"`
+	Resources []MCPResourceConfig        `json:"resources"`
+	Prompts   map[string]MCPPromptConfig `json:"prompts"`
+
+	ToolsPageSize int `json:"tools_page_size"` // tools/list の 1 ページあたりの件数（既定 100）
+}
+
+// MCPOAuthConfig は MCP 用 OAuth 2.1 認可サーバの設定データを表します。
+type MCPOAuthConfig struct {
+	Enabled                  bool          `json:"enabled"`
+	Issuer                   string        `json:"issuer"`            // 外部公開URL（空ならリクエストから推定）
+	AccessTokenTTL           int           `json:"access_token_ttl"`  // 秒
+	RefreshTokenTTL          int           `json:"refresh_token_ttl"` // 秒
+	AuthCodeTTL              int           `json:"auth_code_ttl"`     // 秒
+	Scopes                   []string      `json:"scopes"`            // 発行可能なスコープ
+	AllowDynamicRegistration bool          `json:"allow_dynamic_registration"`
+	RegistrationStore        string        `json:"registration_store"` // 動的登録クライアントの保存先（任意）
+	RedirectSchemes          []string      `json:"redirect_schemes"`   // 動的登録で許可するアプリ独自のスキーム（"vscode" など）
+	Users                    []OAuthUser   `json:"users"`
+	Clients                  []OAuthClient `json:"clients"`
+}
+
+// OAuthUser は同意画面でログインできるユーザーを表します。
+// password_hash（bcrypt）を推奨しますが、開発用に平文の password も受け付けます。
+type OAuthUser struct {
+	Username     string   `json:"username"`
+	Password     string   `json:"password,omitempty"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"` // 空なら全スコープを許可
+	Roles        []string `json:"roles,omitempty"`  // api.json の roles と照合するロール
+}
+
+// OAuthClient は認可サーバに登録されたクライアントを表します。
+type OAuthClient struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"` // none / client_secret_post / client_secret_basic
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at,omitempty"`
+}
+
+// oauthAuthCode は発行済みの認可コードを表します。
+type oauthAuthCode struct {
+	ClientID      string
+	RedirectURI   string
+	CodeChallenge string
+	Subject       string
+	Scope         []string
+	Roles         []string
+	Resource      string
+	ExpiresAt     time.Time
+}
+
+// oauthToken は発行済みのアクセストークン / リフレッシュトークンを表します。
+type oauthToken struct {
+	ClientID  string
+	Subject   string
+	Scope     []string
+	Roles     []string // 認可したユーザーのロール
+	Resource  string
+	ExpiresAt time.Time
+
+	AccessToken string // リフレッシュトークンと同時に発行したアクセストークン（ローテーション時に失効させる）
+}
+
+var (
+	oauthClients       sync.Map // client_id -> *OAuthClient
+	oauthAuthCodes     sync.Map // code -> *oauthAuthCode
+	oauthAccessTokens  sync.Map // token -> *oauthToken
+	oauthRefreshTokens sync.Map // token -> *oauthToken
+	oauthRegisterMu    sync.Mutex
+)
+
+const (
+	defaultOAuthAccessTokenTTL  = 3600
+	defaultOAuthRefreshTokenTTL = 30 * 24 * 3600
+	defaultOAuthAuthCodeTTL     = 60
+
+	oauthPurgeInterval = time.Minute
+)
+
+// ginContext のキー（Bearer 検証済みトークン）
+const mcpOAuthTokenKey = "nyan.mcpOAuthToken"
+
+// initMCPOAuth は config.json と登録ストアからクライアントを読み込みます。
+func initMCPOAuth(execDir string) error {
+	o := globalConfig.MCP.OAuth
+	if !o.Enabled {
+		return nil
+	}
+	for i := range o.Clients {
+		cl := o.Clients[i]
+		if cl.ClientID == "" {
+			return fmt.Errorf("mcp.oauth.clients[%d]: client_id is required", i)
+		}
+		oauthClients.Store(cl.ClientID, &cl)
+	}
+	go oauthJanitor(oauthPurgeInterval)
+
+	storePath, err := resolvePath(execDir, o.RegistrationStore)
+	if err != nil {
+		return fmt.Errorf("invalid mcp.oauth.registration_store: %w", err)
+	}
+	if storePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var registered []OAuthClient
+	if err := json.Unmarshal(data, &registered); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", storePath, err)
+	}
+	for i := range registered {
+		cl := registered[i]
+		oauthClients.LoadOrStore(cl.ClientID, &cl)
+	}
+	return nil
+}
+
+// oauthJanitor は期限切れの認可コードとトークンを定期的に削除します。
+// 使われずに期限が切れたものはここで消さないとメモリに残り続けます。
+func oauthJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		n := 0
+		oauthAuthCodes.Range(func(k, v any) bool {
+			if now.After(v.(*oauthAuthCode).ExpiresAt) && oauthAuthCodes.CompareAndDelete(k, v) {
+				n++
+			}
+			return true
+		})
+		for _, m := range []*sync.Map{&oauthAccessTokens, &oauthRefreshTokens} {
+			m.Range(func(k, v any) bool {
+				if now.After(v.(*oauthToken).ExpiresAt) && m.CompareAndDelete(k, v) {
+					n++
+				}
+				return true
+			})
+		}
+		if n > 0 {
+			logger.Printf("OAuth: purged %d expired codes and tokens", n)
+		}
+	}
+}
+
+// registerMCPOAuthRoutes は OAuth 関連のエンドポイントを登録します。
+// メタデータは OAuth 無効時でも 404 を返すだけなので常に登録しておきます。
+func registerMCPOAuthRoutes(r *gin.Engine) {
+	r.GET("/.well-known/oauth-protected-resource", handleOAuthProtectedResource)
+	r.GET("/.well-known/oauth-protected-resource/*resource", handleOAuthProtectedResource)
+	r.GET("/.well-known/oauth-authorization-server", handleOAuthServerMetadata)
+	r.GET("/oauth/authorize", handleOAuthAuthorize)
+	r.POST("/oauth/authorize", handleOAuthAuthorizeDecision)
+	r.POST("/oauth/token", handleOAuthToken)
+	r.POST("/oauth/register", handleOAuthRegister)
+}
+
+// oauthIssuer は認可サーバの issuer URL を返します。
+// X-Forwarded-Proto は trusted_proxies からの接続でのみ参照します。
+func oauthIssuer(c *gin.Context) string {
+	if iss := strings.TrimRight(globalConfig.MCP.OAuth.Issuer, "/"); iss != "" {
+		return iss
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if fromTrustedProxy(c.Request) {
+		switch p := strings.ToLower(c.GetHeader("X-Forwarded-Proto")); p {
+		case "http", "https":
+			scheme = p
+		}
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// mcpResourceURL は保護対象リソース（/nyan-toolbox）の URL を返します。
+func mcpResourceURL(c *gin.Context) string {
+	return oauthIssuer(c) + "/nyan-toolbox"
+}
+
+func oauthScopesSupported() []string {
+	if s := globalConfig.MCP.OAuth.Scopes; len(s) > 0 {
+		return s
+	}
+	return []string{"mcp"}
+}
+
+// GET /.well-known/oauth-protected-resource （RFC 9728）
+func handleOAuthProtectedResource(c *gin.Context) {
+	if !globalConfig.MCP.OAuth.Enabled {
+		respondWithError(c, http.StatusNotFound, "OAuth is not enabled", nil)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"resource":                 mcpResourceURL(c),
+		"authorization_servers":    []string{oauthIssuer(c)},
+		"scopes_supported":         oauthScopesSupported(),
+		"bearer_methods_supported": []string{"header"},
+		"resource_name":            globalConfig.Name,
+	})
+}
+
+// GET /.well-known/oauth-authorization-server （RFC 8414）
+func handleOAuthServerMetadata(c *gin.Context) {
+	o := globalConfig.MCP.OAuth
+	if !o.Enabled {
+		respondWithError(c, http.StatusNotFound, "OAuth is not enabled", nil)
+		return
+	}
+	iss := oauthIssuer(c)
+	meta := gin.H{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/oauth/authorize",
+		"token_endpoint":                        iss + "/oauth/token",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"none", "client_secret_post", "client_secret_basic"},
+		"scopes_supported":                      oauthScopesSupported(),
+	}
+	if o.AllowDynamicRegistration {
+		meta["registration_endpoint"] = iss + "/oauth/register"
+	}
+	c.JSON(http.StatusOK, meta)
+}
+
+// MCPOAuthMiddleware は /nyan-toolbox への Bearer トークンを検証します。
+// OAuth 無効時は何もしません。
+func MCPOAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !globalConfig.MCP.OAuth.Enabled {
+			c.Next()
+			return
+		}
+		challenge := fmt.Sprintf(`Bearer resource_metadata="%s/.well-known/oauth-protected-resource"`, oauthIssuer(c))
+
+		authz := c.GetHeader("Authorization")
+		if len(authz) < 7 || !strings.EqualFold(authz[:7], "Bearer ") {
+			c.Header("WWW-Authenticate", challenge)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		tok := lookupAccessToken(strings.TrimSpace(authz[7:]))
+		if tok == nil || (tok.Resource != "" && tok.Resource != mcpResourceURL(c)) {
+			c.Header("WWW-Authenticate", challenge+`, error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+			return
+		}
+		c.Set(mcpOAuthTokenKey, tok)
+		c.Next()
+	}
+}
+
+// mcpSubject は Bearer 検証済みのユーザー名を返します（OAuth 無効時は空）。
+func mcpSubject(c *gin.Context) string {
+	if v, ok := c.Get(mcpOAuthTokenKey); ok {
+		return v.(*oauthToken).Subject
+	}
+	return ""
+}
+
+// lookupAccessToken は有効なアクセストークンを返します（期限切れは削除）。
+func lookupAccessToken(token string) *oauthToken {
+	raw, ok := oauthAccessTokens.Load(token)
+	if !ok {
+		return nil
+	}
+	tok := raw.(*oauthToken)
+	if time.Now().After(tok.ExpiresAt) {
+		oauthAccessTokens.Delete(token)
+		return nil
+	}
+	return tok
+}
+
+func loadOAuthClient(clientID string) *OAuthClient {
+	if raw, ok := oauthClients.Load(clientID); ok {
+		return raw.(*OAuthClient)
+	}
+	return nil
+}
+
+func (cl *OAuthClient) hasRedirectURI(uri string) bool {
+	for _, u := range cl.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// validRedirectURI は動的登録で受け付けるリダイレクト先かを判定します（OAuth 2.1 / RFC 8252）。
+// https、ループバック（localhost / 127.0.0.1 / [::1]）への http、redirect_schemes に書いたアプリ独自のスキームだけを許可します。
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Fragment != "" || u.User != nil {
+		return false
+	}
+	switch scheme := strings.ToLower(u.Scheme); scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		return u.Host != "" && isLocalhost(u.Hostname())
+	case "", "javascript", "data", "vbscript", "file", "blob":
+		return false
+	default:
+		for _, s := range globalConfig.MCP.OAuth.RedirectSchemes {
+			if strings.EqualFold(s, scheme) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (cl *OAuthClient) isPublic() bool {
+	return cl.ClientSecret == "" || cl.TokenEndpointAuthMethod == "none"
+}
+
+// authorizeRequest は /oauth/authorize のパラメータを表します。
+type authorizeRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	State               string
+	Scope               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Resource            string
+}
+
+func readAuthorizeRequest(get func(string) string) authorizeRequest {
+	return authorizeRequest{
+		ClientID:            get("client_id"),
+		RedirectURI:         get("redirect_uri"),
+		ResponseType:        get("response_type"),
+		State:               get("state"),
+		Scope:               get("scope"),
+		CodeChallenge:       get("code_challenge"),
+		CodeChallengeMethod: get("code_challenge_method"),
+		Resource:            get("resource"),
+	}
+}
+
+// validate はリクエストを検証します。
+// リダイレクト先が信頼できない場合は redirectable=false を返し、画面にエラーを表示します。
+func (ar authorizeRequest) validate() (cl *OAuthClient, redirectable bool, errCode, errDesc string) {
+	cl = loadOAuthClient(ar.ClientID)
+	if cl == nil {
+		return nil, false, "invalid_client", "unknown client_id"
+	}
+	if !cl.hasRedirectURI(ar.RedirectURI) {
+		return cl, false, "invalid_request", "redirect_uri is not registered"
+	}
+	if ar.ResponseType != "code" {
+		return cl, true, "unsupported_response_type", "response_type must be code"
+	}
+	if ar.CodeChallenge == "" || ar.CodeChallengeMethod != "S256" {
+		return cl, true, "invalid_request", "PKCE (code_challenge_method=S256) is required"
+	}
+	for _, s := range strings.Fields(ar.Scope) {
+		if !containsString(oauthScopesSupported(), s) {
+			return cl, true, "invalid_scope", "unsupported scope: " + s
+		}
+	}
+	return cl, true, "", ""
+}
+
+func (ar authorizeRequest) redirectWithError(c *gin.Context, errCode, errDesc string) {
+	q := url.Values{}
+	q.Set("error", errCode)
+	if errDesc != "" {
+		q.Set("error_description", errDesc)
+	}
+	if ar.State != "" {
+		q.Set("state", ar.State)
+	}
+	c.Redirect(http.StatusFound, appendQuery(ar.RedirectURI, q))
+}
+
+// GET /oauth/authorize ：同意画面の表示
+func handleOAuthAuthorize(c *gin.Context) {
+	if !globalConfig.MCP.OAuth.Enabled {
+		respondWithError(c, http.StatusNotFound, "OAuth is not enabled", nil)
+		return
+	}
+	ar := readAuthorizeRequest(c.Query)
+	cl, redirectable, errCode, errDesc := ar.validate()
+	if errCode != "" {
+		if redirectable {
+			ar.redirectWithError(c, errCode, errDesc)
+			return
+		}
+		renderConsentPage(c, http.StatusBadRequest, ar, cl, errDesc)
+		return
+	}
+	renderConsentPage(c, http.StatusOK, ar, cl, "")
+}
+
+// POST /oauth/authorize ：ログインと同意の結果を受け取り、認可コードを発行
+func handleOAuthAuthorizeDecision(c *gin.Context) {
+	o := globalConfig.MCP.OAuth
+	if !o.Enabled {
+		respondWithError(c, http.StatusNotFound, "OAuth is not enabled", nil)
+		return
+	}
+	ar := readAuthorizeRequest(c.PostForm)
+	cl, redirectable, errCode, errDesc := ar.validate()
+	if errCode != "" {
+		if redirectable {
+			ar.redirectWithError(c, errCode, errDesc)
+			return
+		}
+		renderConsentPage(c, http.StatusBadRequest, ar, cl, errDesc)
+		return
+	}
+
+	if c.PostForm("decision") != "approve" {
+		ar.redirectWithError(c, "access_denied", "the user denied the request")
+		return
+	}
+
+	// パスワードの総当たりを防ぐため、IP とユーザー名の組ごとに失敗を数える
+	username := c.PostForm("username")
+	if gerr := checkAuthFailures(c, username); gerr != nil {
+		for k, v := range gerr.Headers {
+			c.Header(k, v)
+		}
+		renderConsentPage(c, gerr.Status, ar, cl, "ログインの失敗が多すぎます。しばらくしてから再度お試しください。")
+		return
+	}
+	user := findOAuthUser(username)
+	if user == nil || !user.checkPassword(c.PostForm("password")) {
+		recordAuthFailure(c, username)
+		renderConsentPage(c, http.StatusUnauthorized, ar, cl, "ユーザー名またはパスワードが正しくありません。")
+		return
+	}
+
+	scope := strings.Fields(ar.Scope)
+	if len(scope) == 0 {
+		scope = oauthScopesSupported()
+	}
+	if len(user.Scopes) > 0 {
+		granted := []string{}
+		for _, s := range scope {
+			if containsString(user.Scopes, s) {
+				granted = append(granted, s)
+			}
+		}
+		scope = granted
+	}
+
+	code := generateSecureSessionID()
+	oauthAuthCodes.Store(code, &oauthAuthCode{
+		ClientID:      cl.ClientID,
+		RedirectURI:   ar.RedirectURI,
+		CodeChallenge: ar.CodeChallenge,
+		Subject:       user.Username,
+		Scope:         scope,
+		Roles:         user.Roles,
+		Resource:      ar.Resource,
+		ExpiresAt:     time.Now().Add(ttlSeconds(o.AuthCodeTTL, defaultOAuthAuthCodeTTL)),
+	})
+	logger.Printf("OAuth: issued authorization code to client %s for user %s", cl.ClientID, user.Username)
+
+	q := url.Values{}
+	q.Set("code", code)
+	if ar.State != "" {
+		q.Set("state", ar.State)
+	}
+	c.Redirect(http.StatusFound, appendQuery(ar.RedirectURI, q))
+}
+
+// POST /oauth/token
+func handleOAuthToken(c *gin.Context) {
+	o := globalConfig.MCP.OAuth
+	if !o.Enabled {
+		oauthError(c, http.StatusNotFound, "invalid_request", "OAuth is not enabled")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+
+	cl, ok := authenticateOAuthClient(c)
+	if !ok {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		code := c.PostForm("code")
+		raw, ok := oauthAuthCodes.LoadAndDelete(code) // 認可コードは一度だけ使用可能
+		if !ok {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "unknown or used code")
+			return
+		}
+		ac := raw.(*oauthAuthCode)
+		if time.Now().After(ac.ExpiresAt) || ac.ClientID != cl.ClientID || ac.RedirectURI != c.PostForm("redirect_uri") {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "code is expired or does not match")
+			return
+		}
+		if !verifyPKCE(c.PostForm("code_verifier"), ac.CodeChallenge) {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+			return
+		}
+		if res := c.PostForm("resource"); res != "" && ac.Resource != "" && res != ac.Resource {
+			oauthError(c, http.StatusBadRequest, "invalid_target", "resource does not match")
+			return
+		}
+		issueOAuthTokens(c, &oauthToken{
+			ClientID: cl.ClientID,
+			Subject:  ac.Subject,
+			Scope:    ac.Scope,
+			Roles:    ac.Roles,
+			Resource: ac.Resource,
+		})
+
+	case "refresh_token":
+		// 別のクライアントが送ってきたトークンを消費しないよう、検証してから削除する
+		refreshToken := c.PostForm("refresh_token")
+		raw, ok := oauthRefreshTokens.Load(refreshToken)
+		if !ok {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "unknown refresh_token")
+			return
+		}
+		rt := raw.(*oauthToken)
+		if rt.ClientID != cl.ClientID {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh_token was not issued to this client")
+			return
+		}
+		if time.Now().After(rt.ExpiresAt) {
+			oauthRefreshTokens.CompareAndDelete(refreshToken, raw)
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh_token is expired")
+			return
+		}
+		scope := rt.Scope
+		if s := strings.Fields(c.PostForm("scope")); len(s) > 0 {
+			for _, v := range s {
+				if !containsString(rt.Scope, v) {
+					oauthError(c, http.StatusBadRequest, "invalid_scope", "scope exceeds the original grant")
+					return
+				}
+			}
+			scope = s
+		}
+		// ローテーション（同時に送られた場合は先に削除した方だけが新しいトークンを受け取る）
+		if !oauthRefreshTokens.CompareAndDelete(refreshToken, raw) {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "unknown refresh_token")
+			return
+		}
+		oauthAccessTokens.Delete(rt.AccessToken) // 古いリフレッシュトークンと組のアクセストークンも失効させる
+		issueOAuthTokens(c, &oauthToken{
+			ClientID: rt.ClientID,
+			Subject:  rt.Subject,
+			Scope:    scope,
+			Roles:    rt.Roles,
+			Resource: rt.Resource,
+		})
+
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// issueOAuthTokens はアクセストークンとリフレッシュトークンを発行して返します。
+func issueOAuthTokens(c *gin.Context, base *oauthToken) {
+	o := globalConfig.MCP.OAuth
+	now := time.Now()
+	accessTTL := ttlSeconds(o.AccessTokenTTL, defaultOAuthAccessTokenTTL)
+
+	access := *base
+	access.ExpiresAt = now.Add(accessTTL)
+	accessToken := generateSecureSessionID()
+	oauthAccessTokens.Store(accessToken, &access)
+
+	refresh := *base
+	refresh.AccessToken = accessToken
+	refresh.ExpiresAt = now.Add(ttlSeconds(o.RefreshTokenTTL, defaultOAuthRefreshTokenTTL))
+	refreshToken := generateSecureSessionID()
+	oauthRefreshTokens.Store(refreshToken, &refresh)
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(accessTTL.Seconds()),
+		"refresh_token": refreshToken,
+		"scope":         strings.Join(base.Scope, " "),
+	})
+}
+
+// authenticateOAuthClient はトークンエンドポイントでクライアントを認証します。
+func authenticateOAuthClient(c *gin.Context) (*OAuthClient, bool) {
+	clientID, secret, hasBasic := c.Request.BasicAuth()
+	if !hasBasic {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+	cl := loadOAuthClient(clientID)
+	if cl == nil {
+		return nil, false
+	}
+	if cl.isPublic() {
+		return cl, true
+	}
+	return cl, subtle.ConstantTimeCompare([]byte(cl.ClientSecret), []byte(secret)) == 1
+}
+
+// POST /oauth/register （RFC 7591 動的クライアント登録）
+func handleOAuthRegister(c *gin.Context) {
+	o := globalConfig.MCP.OAuth
+	if !o.Enabled || !o.AllowDynamicRegistration {
+		oauthError(c, http.StatusNotFound, "invalid_request", "dynamic client registration is not enabled")
+		return
+	}
+	var req OAuthClient
+	if err := c.ShouldBindJSON(&req); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_client_metadata", err.Error())
+		return
+	}
+	if len(req.RedirectURIs) == 0 {
+		oauthError(c, http.StatusBadRequest, "invalid_redirect_uri", "redirect_uris is required")
+		return
+	}
+	for _, u := range req.RedirectURIs {
+		if !validRedirectURI(u) {
+			oauthError(c, http.StatusBadRequest, "invalid_redirect_uri", "invalid redirect_uri: "+u+" (https, http on localhost, or a scheme listed in mcp.oauth.redirect_schemes)")
+			return
+		}
+	}
+
+	cl := &OAuthClient{
+		ClientID:                generateSecureSessionID(),
+		ClientName:              req.ClientName,
+		RedirectURIs:            req.RedirectURIs,
+		TokenEndpointAuthMethod: req.TokenEndpointAuthMethod,
+		ClientIDIssuedAt:        time.Now().Unix(),
+	}
+	switch cl.TokenEndpointAuthMethod {
+	case "", "none":
+		cl.TokenEndpointAuthMethod = "none"
+	case "client_secret_post", "client_secret_basic":
+		cl.ClientSecret = generateSecureSessionID()
+	default:
+		oauthError(c, http.StatusBadRequest, "invalid_client_metadata", "unsupported token_endpoint_auth_method")
+		return
+	}
+	oauthClients.Store(cl.ClientID, cl)
+	if err := saveRegisteredOAuthClients(); err != nil {
+		logger.Printf("OAuth: failed to save registered clients: %v", err)
+	}
+	logger.Printf("OAuth: registered client %s (%s)", cl.ClientID, cl.ClientName)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"client_id":                  cl.ClientID,
+		"client_secret":              cl.ClientSecret,
+		"client_id_issued_at":        cl.ClientIDIssuedAt,
+		"client_secret_expires_at":   0,
+		"client_name":                cl.ClientName,
+		"redirect_uris":              cl.RedirectURIs,
+		"token_endpoint_auth_method": cl.TokenEndpointAuthMethod,
+		"grant_types":                []string{"authorization_code", "refresh_token"},
+		"response_types":             []string{"code"},
+	})
+}
+
+// saveRegisteredOAuthClients は動的登録されたクライアントを registration_store に保存します。
+func saveRegisteredOAuthClients() error {
+	o := globalConfig.MCP.OAuth
+	if o.RegistrationStore == "" {
+		return nil
+	}
+	storePath, err := resolvePath(getBaseDir(), o.RegistrationStore)
+	if err != nil {
+		return err
+	}
+
+	oauthRegisterMu.Lock()
+	defer oauthRegisterMu.Unlock()
+
+	registered := []OAuthClient{}
+	oauthClients.Range(func(_, v any) bool {
+		if cl := v.(*OAuthClient); cl.ClientIDIssuedAt != 0 {
+			registered = append(registered, *cl)
+		}
+		return true
+	})
+	data, err := json.MarshalIndent(registered, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(storePath, data, 0600)
+}
+
+func findOAuthUser(username string) *OAuthUser {
+	for i := range globalConfig.MCP.OAuth.Users {
+		if u := &globalConfig.MCP.OAuth.Users[i]; u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+func (u *OAuthUser) checkPassword(password string) bool {
+	if u.PasswordHash != "" {
+		return verifyPasswordHash(u.PasswordHash, password)
+	}
+	return u.Password != "" && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+}
+
+// verifyPasswordHash は bcrypt ハッシュとパスワードを照合します。
+func verifyPasswordHash(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// verifyPKCE は S256 の code_verifier を検証します。
+func verifyPKCE(verifier, challenge string) bool {
+	if verifier == "" || challenge == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func oauthError(c *gin.Context, status int, code, desc string) {
+	body := gin.H{"error": code}
+	if desc != "" {
+		body["error_description"] = desc
+	}
+	c.AbortWithStatusJSON(status, body)
+}
+
+func appendQuery(rawURL string, q url.Values) string {
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + q.Encode()
+}
+
+func ttlSeconds(v, def int) time.Duration {
+	if v <= 0 {
+		v = def
+	}
+	return time.Duration(v) * time.Second
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 同意画面のテンプレート
+var consentPageTmpl = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.ServerName}} - アクセスの許可</title>
+<style>
+body{font-family:sans-serif;background:#f5f5f5;margin:0;padding:2em}
+.box{max-width:420px;margin:auto;background:#fff;padding:1.5em 2em;border-radius:8px;box-shadow:0 1px 4px rgba(0,0,0,.15)}
+.err{color:#c00}
+label{display:block;margin-top:1em}
+input[type=text],input[type=password]{width:100%;padding:.4em;box-sizing:border-box}
+.buttons{margin-top:1.5em;display:flex;gap:1em}
+</style>
+</head>
+<body>
+<div class="box">
+<h1>{{.ServerName}}</h1>
+{{if .Error}}<p class="err">{{.Error}}</p>{{end}}
+{{if .Client}}
+<p><strong>{{.ClientName}}</strong> が MCP ツールへのアクセスを求めています。</p>
+{{if .Scopes}}<p>要求されたスコープ：{{range .Scopes}}<code>{{.}}</code> {{end}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+<input type="hidden" name="client_id" value="{{.Req.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Req.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.Req.ResponseType}}">
+<input type="hidden" name="state" value="{{.Req.State}}">
+<input type="hidden" name="scope" value="{{.Req.Scope}}">
+<input type="hidden" name="code_challenge" value="{{.Req.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Req.CodeChallengeMethod}}">
+<input type="hidden" name="resource" value="{{.Req.Resource}}">
+<label>ユーザー名<input type="text" name="username" autocomplete="username"></label>
+<label>パスワード<input type="password" name="password" autocomplete="current-password"></label>
+<div class="buttons">
+<button type="submit" name="decision" value="approve">許可する</button>
+<button type="submit" name="decision" value="deny">拒否する</button>
+</div>
+</form>
+{{end}}
+</div>
+</body>
+</html>
+`))
+
+func renderConsentPage(c *gin.Context, status int, ar authorizeRequest, cl *OAuthClient, errMsg string) {
+	data := map[string]any{
+		"ServerName": globalConfig.Name,
+		"Error":      errMsg,
+		"Req":        ar,
+		"Scopes":     strings.Fields(ar.Scope),
+	}
+	// リダイレクト先が検証できない場合はフォームを出さない
+	if cl != nil && cl.hasRedirectURI(ar.RedirectURI) {
+		data["Client"] = cl
+		name := cl.ClientName
+		if name == "" {
+			name = cl.ClientID
+		}
+		data["ClientName"] = name
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Status(status)
+	if err := consentPageTmpl.Execute(c.Writer, data); err != nil {
+		logger.Printf("OAuth: failed to render consent page: %v", err)
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MCPResourceConfig は MCP で公開するリソースの定義です。
+// dir を指定するとディレクトリ配下のファイルを、script を指定すると JS の結果を公開します。
+type MCPResourceConfig struct {
+	Name        string   `json:"name"` // URI のホスト部（nyan://<name>/...）
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Dir         string   `json:"dir,omitempty"`         // ディレクトリ公開
+	Script      string   `json:"script,omitempty"`      // スクリプト公開
+	URITemplate string   `json:"uriTemplate,omitempty"` // スクリプト公開時のテンプレート（例: nyan://reports/{id}）
+	MimeType    string   `json:"mimeType,omitempty"`    // 既定の MIME タイプ
+	Allow       []string `json:"allow,omitempty"`       // スクリプトに許可する機能（api.json の allow と同じ）
+
+	// スクリプト公開のリソースの実行前チェック（api.json の同名の設定と同じ書式）
+	Auth        any `json:"auth,omitempty"`
+	Roles       any `json:"roles,omitempty"`
+	Scopes      any `json:"scopes,omitempty"`
+	IPFilter    any `json:"ip_filter,omitempty"`
+	RateLimit   any `json:"rate_limit,omitempty"`
+	Concurrency any `json:"concurrency,omitempty"`
+}
+
+// guardInfo は実行前チェック（guardAPICall / acquireAPISlot）に渡す api.json 相当の設定を返します。
+func (rc *MCPResourceConfig) guardInfo() map[string]any {
+	info := map[string]any{}
+	for k, v := range map[string]any{
+		"auth":        rc.Auth,
+		"roles":       rc.Roles,
+		"scopes":      rc.Scopes,
+		"ip_filter":   rc.IPFilter,
+		"rate_limit":  rc.RateLimit,
+		"concurrency": rc.Concurrency,
+	} {
+		if v != nil {
+			info[k] = v
+		}
+	}
+	return info
+}
+
+// mcpBaseDir は MCP のツール・リソース・プロンプトが相対パスを解決する基準ディレクトリです。
+// mcp-stdio では起動時に config.json のディレクトリへ移動しているため、HTTP と同じくカレントディレクトリを使います。
+func mcpBaseDir() (string, error) {
+	return os.Getwd()
+}
+
+// MCPPromptConfig は prompts/get で展開するプロンプトテンプレートです。
+type MCPPromptConfig struct {
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Arguments   []MCPPromptArgument `json:"arguments,omitempty"`
+	Messages    []MCPPromptMessage  `json:"messages"`
+}
+
+// MCPPromptArgument はプロンプトの引数定義です。
+type MCPPromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// MCPPromptMessage はプロンプトの 1 メッセージです。
+// text は Go の text/template 形式（{{.引数名}}）で展開されます。file を指定するとファイルの内容をテンプレートとして使います。
+type MCPPromptMessage struct {
+	Role string `json:"role"` // user / assistant
+	Text string `json:"text,omitempty"`
+	File string `json:"file,omitempty"`
+}
+
+const mcpResourceScheme = "nyan://"
+
+// MCP 仕様のエラーコード（リソースが見つからない）
+const mcpErrResourceNotFound = -32002
+
+// mcpCapabilities は initialize で返すサーバの capabilities を組み立てます。
+func mcpCapabilities() map[string]any {
+	caps := map[string]any{
+		"tools": map[string]any{"listChanged": false},
+	}
+	if len(globalConfig.MCP.Resources) > 0 {
+		caps["resources"] = map[string]any{"listChanged": false, "subscribe": false}
+	}
+	if len(globalConfig.MCP.Prompts) > 0 {
+		caps["prompts"] = map[string]any{"listChanged": false}
+	}
+	return caps
+}
+
+// writeMCPResult は JSON-RPC の結果またはエラーを返します。
+func writeMCPResult(c *gin.Context, id any, result any, rpcErr *JSONRPCError) {
+	if rpcErr != nil {
+		c.JSON(http.StatusOK, map[string]any{"jsonrpc": "2.0", "id": id, "error": rpcErr})
+		return
+	}
+	c.JSON(http.StatusOK, map[string]any{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+// findMCPResource は URI のホスト部から対象のリソース定義と残りのパスを返します。
+func findMCPResource(uri string) (*MCPResourceConfig, string) {
+	if !strings.HasPrefix(uri, mcpResourceScheme) {
+		return nil, ""
+	}
+	rest := strings.TrimPrefix(uri, mcpResourceScheme)
+	name, sub, _ := strings.Cut(rest, "/")
+	for i := range globalConfig.MCP.Resources {
+		if rc := &globalConfig.MCP.Resources[i]; rc.Name == name {
+			return rc, sub
+		}
+	}
+	return nil, ""
+}
+
+// resources/list
+func mcpResourcesList(c *gin.Context) (map[string]any, *JSONRPCError) {
+	execDir, err := mcpBaseDir()
+	if err != nil {
+		return nil, &JSONRPCError{Code: -32603, Message: "cwd error"}
+	}
+	resources := []map[string]any{}
+	for i := range globalConfig.MCP.Resources {
+		rc := &globalConfig.MCP.Resources[i]
+		switch {
+		case rc.Dir != "":
+			items, err := listDirResources(execDir, rc)
+			if err != nil {
+				logger.Printf("MCP: failed to list resources for %s: %v", rc.Name, err)
+				continue
+			}
+			resources = append(resources, items...)
+		case rc.Script != "":
+			out, err := runResourceScript(execDir, rc, map[string]any{"method": "list"}, c)
+			if err != nil {
+				logger.Printf("MCP: resource script %s failed: %v", rc.Name, err)
+				continue
+			}
+			if list, ok := out["resources"].([]any); ok {
+				for _, v := range list {
+					if m, ok := v.(map[string]any); ok {
+						resources = append(resources, m)
+					}
+				}
+			}
+		}
+	}
+	return map[string]any{"resources": resources}, nil
+}
+
+// resources/templates/list
+func mcpResourceTemplatesList() (map[string]any, *JSONRPCError) {
+	templates := []map[string]any{}
+	for i := range globalConfig.MCP.Resources {
+		rc := &globalConfig.MCP.Resources[i]
+		tmpl := rc.URITemplate
+		if tmpl == "" && rc.Dir != "" {
+			tmpl = mcpResourceScheme + rc.Name + "/{path}"
+		}
+		if tmpl == "" {
+			continue
+		}
+		t := map[string]any{
+			"uriTemplate": tmpl,
+			"name":        rc.Name,
+			"description": rc.Description,
+		}
+		if rc.Title != "" {
+			t["title"] = rc.Title
+		}
+		if rc.MimeType != "" {
+			t["mimeType"] = rc.MimeType
+		}
+		templates = append(templates, t)
+	}
+	return map[string]any{"resourceTemplates": templates}, nil
+}
+
+// resources/read
+func mcpResourcesRead(c *gin.Context, params json.RawMessage) (map[string]any, *JSONRPCError) {
+	var p struct {
+		URI string `json:"uri"`
+	}
+	_ = json.Unmarshal(params, &p)
+	rc, sub := findMCPResource(p.URI)
+	if rc == nil {
+		return nil, &JSONRPCError{Code: mcpErrResourceNotFound, Message: "Resource not found", Data: map[string]any{"uri": p.URI}}
+	}
+	execDir, err := mcpBaseDir()
+	if err != nil {
+		return nil, &JSONRPCError{Code: -32603, Message: "cwd error"}
+	}
+
+	if rc.Dir != "" {
+		content, err := readDirResource(execDir, rc, sub)
+		if err != nil {
+			return nil, &JSONRPCError{Code: mcpErrResourceNotFound, Message: "Resource not found", Data: map[string]any{"uri": p.URI}}
+		}
+		content["uri"] = p.URI
+		return map[string]any{"contents": []map[string]any{content}}, nil
+	}
+
+	args := map[string]any{"method": "read", "uri": p.URI}
+	for k, v := range matchURITemplate(rc.URITemplate, p.URI) {
+		args[k] = v
+	}
+	out, err := runResourceScript(execDir, rc, args, c)
+	var gerr *apiGuardError
+	if errors.As(err, &gerr) {
+		if c != nil {
+			for k, v := range gerr.Headers {
+				c.Header(k, v) // Retry-After などは HTTP 応答にも載せる
+			}
+		}
+		return nil, &JSONRPCError{Code: jsonRPCCodeForStatus(gerr.Status), Message: gerr.Message}
+	}
+	if err != nil {
+		return nil, &JSONRPCError{Code: -32603, Message: "Resource script failed", Data: err.Error()}
+	}
+	if success, ok := out["success"].(bool); ok && !success {
+		return nil, &JSONRPCError{Code: mcpErrResourceNotFound, Message: "Resource not found", Data: out}
+	}
+	if contents, ok := out["contents"].([]any); ok {
+		return map[string]any{"contents": contents}, nil
+	}
+	// contents が無ければ text / blob を 1 件として扱う
+	item := map[string]any{"uri": p.URI}
+	if mt, _ := out["mimeType"].(string); mt != "" {
+		item["mimeType"] = mt
+	} else if rc.MimeType != "" {
+		item["mimeType"] = rc.MimeType
+	}
+	if blob, ok := out["blob"].(string); ok {
+		item["blob"] = blob
+	} else if text, ok := out["text"].(string); ok {
+		item["text"] = text
+	} else {
+		js, _ := json.Marshal(out["data"])
+		item["text"] = string(js)
+		if _, ok := item["mimeType"]; !ok {
+			item["mimeType"] = "application/json"
+		}
+	}
+	return map[string]any{"contents": []map[string]any{item}}, nil
+}
+
+// listDirResources はディレクトリ配下のファイルをリソースとして列挙します。
+func listDirResources(execDir string, rc *MCPResourceConfig) ([]map[string]any, error) {
+	root, err := resolvePath(execDir, rc.Dir)
+	if err != nil {
+		return nil, err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("resource root is not accessible: %w", err)
+	}
+	items := []map[string]any{}
+	err = filepath.WalkDir(realRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			// 読み込めないリンク（ディレクトリ外を指すもの）は一覧に出さない
+			if real, err := filepath.EvalSymlinks(p); err != nil || !pathWithin(realRoot, real) {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(realRoot, p)
+		if err != nil {
+			return nil
+		}
+		item := map[string]any{
+			"uri":  mcpResourceScheme + rc.Name + "/" + filepath.ToSlash(rel),
+			"name": filepath.ToSlash(rel),
+		}
+		if mt := resourceMimeType(rc, p); mt != "" {
+			item["mimeType"] = mt
+		}
+		if info, err := os.Stat(p); err == nil { // シンボリックリンクはリンク先の大きさ
+			item["size"] = info.Size()
+		}
+		items = append(items, item)
+		return nil
+	})
+	sort.Slice(items, func(i, j int) bool { return items[i]["uri"].(string) < items[j]["uri"].(string) })
+	return items, err
+}
+
+// readDirResource はディレクトリ公開リソースを読み込みます。
+// シンボリックリンクを辿った先も含め、ディレクトリ外への参照は拒否します。
+func readDirResource(execDir string, rc *MCPResourceConfig, sub string) (map[string]any, error) {
+	root, err := resolvePath(execDir, rc.Dir)
+	if err != nil {
+		return nil, err
+	}
+	clean := path.Clean("/" + sub)
+	if clean == "/" {
+		return nil, fmt.Errorf("no file specified")
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("resource root is not accessible: %w", err)
+	}
+	full, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(clean)))
+	if err != nil {
+		return nil, err
+	}
+	if !pathWithin(realRoot, full) {
+		return nil, fmt.Errorf("path escapes resource root")
+	}
+	data, err := os.ReadFile(full)
+	if err != nil {
+		return nil, err
+	}
+	mt := resourceMimeType(rc, clean) // 一覧と同じく、リンク先ではなく要求された名前で判定する
+	item := map[string]any{}
+	if mt != "" {
+		item["mimeType"] = mt
+	}
+	if isTextMimeType(mt) {
+		item["text"] = string(data)
+	} else {
+		item["blob"] = base64.StdEncoding.EncodeToString(data)
+	}
+	return item, nil
+}
+
+func resourceMimeType(rc *MCPResourceConfig, p string) string {
+	if rc.MimeType != "" {
+		return rc.MimeType
+	}
+	if mt := mime.TypeByExtension(filepath.Ext(p)); mt != "" {
+		return mt
+	}
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".md":
+		return "text/markdown"
+	case ".txt", ".csv", ".log":
+		return "text/plain"
+	}
+	return "application/octet-stream"
+}
+
+func isTextMimeType(mt string) bool {
+	mt, _, _ = strings.Cut(mt, ";")
+	return strings.HasPrefix(mt, "text/") ||
+		strings.HasSuffix(mt, "json") ||
+		strings.HasSuffix(mt, "xml") ||
+		mt == "application/javascript" ||
+		mt == "application/yaml"
+}
+
+// runResourceScript はリソース用スクリプトを実行し、JSON 結果を返します。
+// ツールと同じ実行前チェックを行い、拒否した場合は *apiGuardError を返します。
+// スクリプトには nyanAllParams.method（list / read）と uri、テンプレート変数が渡されます。
+func runResourceScript(execDir string, rc *MCPResourceConfig, args map[string]any, c *gin.Context) (map[string]any, error) {
+	name := "resource:" + rc.Name
+	info := rc.guardInfo()
+	if gerr := guardAPICall(c, name, info); gerr != nil {
+		return nil, gerr
+	}
+	release, gerr := acquireAPISlot(c, name, info)
+	if gerr != nil {
+		return nil, gerr
+	}
+	defer release()
+
+	params := map[string]any{"api": name}
+	for k, v := range args {
+		params[k] = v
+	}
+	allow := rc.Allow
+	if allow == nil {
+		allow = globalConfig.Sandbox.DefaultAllow
+	}
+	result, err := runJavaScript(filepath.Join(execDir, rc.Script), params, c, newCapabilitySet(name, allow))
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := json.Unmarshal([]byte(result), &out); err != nil {
+		return nil, fmt.Errorf("failed to parse resource script response: %w", err)
+	}
+	return out, nil
+}
+
+var uriTemplateVar = regexp.MustCompile(`\\\{([^}\\]+)\\\}`)
+
+// matchURITemplate は nyan://reports/{id} のような単純なテンプレートから変数を取り出します。
+func matchURITemplate(tmpl, uri string) map[string]string {
+	if tmpl == "" {
+		return nil
+	}
+	names := []string{}
+	// QuoteMeta で { } がエスケープされるため、エスケープ後の形で置換する
+	pattern := uriTemplateVar.ReplaceAllStringFunc("^"+regexp.QuoteMeta(tmpl)+"$", func(m string) string {
+		name := strings.TrimSuffix(strings.TrimPrefix(m, `\{`), `\}`)
+		names = append(names, name)
+		if name == "path" {
+			return "(.+)"
+		}
+		return "([^/]+)"
+	})
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	m := re.FindStringSubmatch(uri)
+	if m == nil {
+		return nil
+	}
+	vars := map[string]string{}
+	for i, name := range names {
+		vars[name] = m[i+1]
+	}
+	return vars
+}
+
+// prompts/list
+func mcpPromptsList() (map[string]any, *JSONRPCError) {
+	names := make([]string, 0, len(globalConfig.MCP.Prompts))
+	for name := range globalConfig.MCP.Prompts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prompts := []map[string]any{}
+	for _, name := range names {
+		pc := globalConfig.MCP.Prompts[name]
+		p := map[string]any{
+			"name":        name,
+			"description": pc.Description,
+			"arguments":   pc.Arguments,
+		}
+		if pc.Title != "" {
+			p["title"] = pc.Title
+		}
+		if pc.Arguments == nil {
+			p["arguments"] = []MCPPromptArgument{}
+		}
+		prompts = append(prompts, p)
+	}
+	return map[string]any{"prompts": prompts}, nil
+}
+
+// prompts/get
+func mcpPromptsGet(params json.RawMessage) (map[string]any, *JSONRPCError) {
+	var p struct {
+		Name      string            `json:"name"`
+		Arguments map[string]string `json:"arguments"`
+	}
+	_ = json.Unmarshal(params, &p)
+	pc, ok := globalConfig.MCP.Prompts[p.Name]
+	if !ok {
+		return nil, &JSONRPCError{Code: -32602, Message: "Unknown prompt: " + p.Name}
+	}
+	args := map[string]string{}
+	for _, a := range pc.Arguments {
+		v, ok := p.Arguments[a.Name]
+		if a.Required && (!ok || v == "") {
+			return nil, &JSONRPCError{Code: -32602, Message: "Missing required argument: " + a.Name}
+		}
+		args[a.Name] = v
+	}
+
+	execDir, err := mcpBaseDir()
+	if err != nil {
+		return nil, &JSONRPCError{Code: -32603, Message: "cwd error"}
+	}
+	messages := []map[string]any{}
+	for i, m := range pc.Messages {
+		src := m.Text
+		if m.File != "" {
+			full, err := resolvePath(execDir, m.File)
+			if err != nil {
+				return nil, &JSONRPCError{Code: -32603, Message: "Invalid prompt file", Data: err.Error()}
+			}
+			data, err := os.ReadFile(full)
+			if err != nil {
+				return nil, &JSONRPCError{Code: -32603, Message: "Failed to read prompt file", Data: err.Error()}
+			}
+			src = string(data)
+		}
+		tmpl, err := template.New(fmt.Sprintf("%s#%d", p.Name, i)).Option("missingkey=zero").Parse(src)
+		if err != nil {
+			return nil, &JSONRPCError{Code: -32603, Message: "Invalid prompt template", Data: err.Error()}
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, args); err != nil {
+			return nil, &JSONRPCError{Code: -32603, Message: "Failed to render prompt", Data: err.Error()}
+		}
+		role := m.Role
+		if role == "" {
+			role = "user"
+		}
+		messages = append(messages, map[string]any{
+			"role":    role,
+			"content": map[string]any{"type": "text", "text": buf.String()},
+		})
+	}
+	return map[string]any{"description": pc.Description, "messages": messages}, nil
+}
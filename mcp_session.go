@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MCPSessionConfig は MCP セッションの寿命・上限・永続化の設定です。
+type MCPSessionConfig struct {
+	TTL             int    `json:"ttl"`              // 作成からの有効期間（秒）。0 なら 24 時間
+	IdleTimeout     int    `json:"idle_timeout"`     // 最終アクセスからの有効期間（秒）。0 なら無制限
+	MaxSessions     int    `json:"max_sessions"`     // 同時セッション数の上限。0 なら無制限
+	OnLimit         string `json:"on_limit"`         // 上限到達時の動作 evict（最も古い利用のセッションを破棄）/ reject
+	CleanupInterval int    `json:"cleanup_interval"` // 期限切れ掃除の間隔（秒）。0 なら 60 秒
+	PersistPath     string `json:"persist_path"`     // 保存先ファイル。空なら永続化しない
+}
+
+// mcpSession は MCP セッションのメタデータです。
+type mcpSession struct {
+	ID                 string         `json:"id"`
+	Created            time.Time      `json:"created"`
+	LastActivity       time.Time      `json:"lastActivity"`
+	ProtocolVersion    string         `json:"protocolVersion"`
+	ClientInfo         map[string]any `json:"clientInfo,omitempty"`
+	ClientCapabilities map[string]any `json:"clientCapabilities,omitempty"`
+	Subject            string         `json:"subject,omitempty"` // OAuth で認可されたユーザー
+	RemoteIP           string         `json:"remoteIp,omitempty"`
+
+	mu sync.Mutex
+}
+
+var (
+	sessionCount    atomic.Int64
+	sessionsDirty   atomic.Bool
+	sessionCreateMu sync.Mutex // 上限判定と登録を直列化
+	sessionSaveMu   sync.Mutex
+)
+
+var errTooManySessions = errors.New("too many MCP sessions")
+
+func mcpSessionTTL() time.Duration {
+	return ttlSeconds(globalConfig.MCP.Session.TTL, int(sessionTTL.Seconds()))
+}
+
+// touch は最終アクセス時刻を更新します。
+func (s *mcpSession) touch() {
+	s.mu.Lock()
+	s.LastActivity = time.Now()
+	s.mu.Unlock()
+	sessionsDirty.Store(true)
+}
+
+// snapshot はロックを取ってコピーを返します（一覧・保存用）。
+func (s *mcpSession) snapshot() mcpSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mcpSession{
+		ID:                 s.ID,
+		Created:            s.Created,
+		LastActivity:       s.LastActivity,
+		ProtocolVersion:    s.ProtocolVersion,
+		ClientInfo:         s.ClientInfo,
+		ClientCapabilities: s.ClientCapabilities,
+		Subject:            s.Subject,
+		RemoteIP:           s.RemoteIP,
+	}
+}
+
+// createMCPSession はセッションを発行して登録します。上限に達している場合は設定に従って破棄または拒否します。
+func createMCPSession(s *mcpSession) error {
+	conf := globalConfig.MCP.Session
+	sessionCreateMu.Lock()
+	defer sessionCreateMu.Unlock()
+
+	if conf.MaxSessions > 0 && sessionCount.Load() >= int64(conf.MaxSessions) {
+		if conf.OnLimit == "reject" {
+			return errTooManySessions
+		}
+		evictLeastRecentlyUsedSession()
+	}
+
+	now := time.Now()
+	s.ID = generateSecureSessionID()
+	s.Created = now
+	s.LastActivity = now
+	storeMCPSession(s)
+	saveMCPSessionsAsync()
+	return nil
+}
+
+func storeMCPSession(s *mcpSession) {
+	if _, loaded := sessions.LoadOrStore(s.ID, s); !loaded {
+		sessionCount.Add(1)
+	}
+}
+
+// deleteMCPSession はセッションを破棄します。存在した場合は true を返します。
+func deleteMCPSession(sid string) bool {
+	if _, ok := sessions.LoadAndDelete(sid); ok {
+		sessionCount.Add(-1)
+		sessionsDirty.Store(true)
+		return true
+	}
+	return false
+}
+
+// lookupMCPSession は有効なセッションを返します。期限切れならその場で破棄します。
+func lookupMCPSession(sid string) *mcpSession {
+	if sid == "" {
+		return nil
+	}
+	raw, ok := sessions.Load(sid)
+	if !ok {
+		return nil
+	}
+	s := raw.(*mcpSession)
+	if !isSessionAlive(s) {
+		deleteMCPSession(sid)
+		return nil
+	}
+	return s
+}
+
+func evictLeastRecentlyUsedSession() {
+	var oldest *mcpSession
+	var oldestAt time.Time
+	sessions.Range(func(_, v any) bool {
+		s := v.(*mcpSession)
+		snap := s.snapshot()
+		if oldest == nil || snap.LastActivity.Before(oldestAt) {
+			oldest, oldestAt = s, snap.LastActivity
+		}
+		return true
+	})
+	if oldest != nil {
+		deleteMCPSession(oldest.ID)
+		logger.Printf("MCP: session limit reached, evicted session %s", oldest.ID)
+	}
+}
+
+// cleanupMCPSessions は期限切れのセッションを破棄し、破棄した件数を返します。
+func cleanupMCPSessions() int {
+	n := 0
+	sessions.Range(func(k, v any) bool {
+		if !isSessionAlive(v.(*mcpSession)) && deleteMCPSession(k.(string)) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// startMCPSessionJanitor は期限切れセッションの掃除と永続化を定期的に行います。
+func startMCPSessionJanitor() {
+	interval := ttlSeconds(globalConfig.MCP.Session.CleanupInterval, 60)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n := cleanupMCPSessions(); n > 0 {
+				logger.Printf("MCP: expired %d session(s)", n)
+			}
+			if sessionsDirty.Load() {
+				if err := saveMCPSessions(); err != nil {
+					logger.Printf("MCP: failed to persist sessions: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// loadMCPSessions は persist_path から期限内のセッションを復元します。
+func loadMCPSessions(execDir string) error {
+	p, err := resolvePath(execDir, globalConfig.MCP.Session.PersistPath)
+	if err != nil || p == "" {
+		return err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var saved []*mcpSession
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	restored := 0
+	for _, s := range saved {
+		if s.ID != "" && isSessionAlive(s) {
+			storeMCPSession(s)
+			restored++
+		}
+	}
+	logger.Printf("MCP: restored %d session(s) from %s", restored, p)
+	return nil
+}
+
+// saveMCPSessions は全セッションを persist_path に書き出します。
+func saveMCPSessions() error {
+	if globalConfig.MCP.Session.PersistPath == "" {
+		return nil
+	}
+	p, err := resolvePath(getBaseDir(), globalConfig.MCP.Session.PersistPath)
+	if err != nil {
+		return err
+	}
+	sessionSaveMu.Lock()
+	defer sessionSaveMu.Unlock()
+	sessionsDirty.Store(false)
+
+	data, err := json.MarshalIndent(listMCPSessions(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0600)
+}
+
+func saveMCPSessionsAsync() {
+	if globalConfig.MCP.Session.PersistPath == "" {
+		return
+	}
+	go func() {
+		if err := saveMCPSessions(); err != nil {
+			logger.Printf("MCP: failed to persist sessions: %v", err)
+		}
+	}()
+}
+
+// listMCPSessions は全セッションのコピーを作成日時順で返します。
+func listMCPSessions() []mcpSession {
+	list := []mcpSession{}
+	sessions.Range(func(_, v any) bool {
+		list = append(list, v.(*mcpSession).snapshot())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// GET /nyan-admin/mcp/sessions
+func handleAdminListMCPSessions(c *gin.Context) {
+	list := listMCPSessions()
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(list),
+		"max":      globalConfig.MCP.Session.MaxSessions,
+		"ttl":      int(mcpSessionTTL().Seconds()),
+		"sessions": list,
+	})
+}
+
+// DELETE /nyan-admin/mcp/sessions/:id
+func handleAdminDeleteMCPSession(c *gin.Context) {
+	if !deleteMCPSession(c.Param("id")) {
+		respondWithError(c, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+	saveMCPSessionsAsync()
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// runMCPStdio は標準入出力で MCP（改行区切りの JSON-RPC）を処理します。
+// stdout は JSON-RPC 専用のため、ログは stderr またはログファイルへ出力してください。
+func runMCPStdio(in io.Reader, out io.Writer) error {
+	var writeMu sync.Mutex
+	write := func(msg any) {
+		js, err := json.Marshal(msg)
+		if err != nil {
+			logger.Printf("MCP stdio: failed to encode response: %v", err)
+			return
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		out.Write(append(js, '\n'))
+	}
+	respond := func(id any, result any, rpcErr *JSONRPCError) {
+		if rpcErr != nil {
+			write(map[string]any{"jsonrpc": "2.0", "id": id, "error": rpcErr})
+			return
+		}
+		write(map[string]any{"jsonrpc": "2.0", "id": id, "result": result})
+	}
+
+	initialized := false
+	reader := bufio.NewReader(in)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			initialized = handleMCPStdioMessage(line, initialized, respond)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read stdin: %w", err)
+		}
+	}
+}
+
+// handleMCPStdioMessage は 1 行分のメッセージを処理し、initialize 済みかどうかを返します。
+func handleMCPStdioMessage(line []byte, initialized bool, respond func(any, any, *JSONRPCError)) bool {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return initialized
+	}
+	var req rpcReq
+	if err := json.Unmarshal(line, &req); err != nil {
+		respond(nil, nil, &JSONRPCError{Code: -32700, Message: "Parse error", Data: err.Error()})
+		return initialized
+	}
+	// id の無いメッセージは通知なので応答しない
+	isNotification := req.ID == nil
+
+	switch {
+	case req.Method == "":
+		// クライアントからの応答（サーバからの要求は送らないので無視）
+		return initialized
+
+	case req.Method == "initialize":
+		res, ver, clientInfo, _ := mcpInitialize(req.Params)
+		logger.Printf("MCP stdio: initialized (protocol %s, client %v)", ver, clientInfo["name"])
+		respond(req.ID, res, nil)
+		return true
+
+	case isNotification:
+		return initialized
+
+	case !initialized && req.Method != "ping":
+		respond(req.ID, nil, &JSONRPCError{Code: -32600, Message: "Invalid Request: server not initialized"})
+		return initialized
+	}
+
+	// HTTP と同じディスパッチ（gin.Context は無し）
+	result, rpcErr := dispatchMCPMethod(nil, req)
+	respond(req.ID, result, rpcErr)
+	return initialized
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// tools/list の 1 ページあたりの既定件数
+const defaultMCPToolsPageSize = 100
+
+// MCP のツールヒント（api.json の annotations で指定可能なもの）
+var mcpToolHintKeys = []string{"readOnlyHint", "destructiveHint", "idempotentHint", "openWorldHint"}
+
+// mcpToolExposed は api.json のエントリを MCP ツールとして公開するかを返します。
+// "mcp": false で非公開になります（push 専用の API など）。
+func mcpToolExposed(api map[string]any) bool {
+	if v, ok := api["mcp"].(bool); ok {
+		return v
+	}
+	return true
+}
+
+// mcpToolAnnotations は api.json の annotations からツールのヒントを取り出します。
+func mcpToolAnnotations(api map[string]any) map[string]any {
+	raw, _ := api["annotations"].(map[string]any)
+	out := map[string]any{}
+	for _, k := range mcpToolHintKeys {
+		if v, ok := raw[k].(bool); ok {
+			out[k] = v
+		}
+	}
+	if title, ok := raw["title"].(string); ok && title != "" {
+		out["title"] = title
+	}
+	return out
+}
+
+func mcpToolsPageSize() int {
+	if n := globalConfig.MCP.ToolsPageSize; n > 0 {
+		return n
+	}
+	return defaultMCPToolsPageSize
+}
+
+// sortedToolNames はページ分割が安定するように api.json のキーを名前順で返します。
+func sortedToolNames(apiConf map[string]any) []string {
+	names := make([]string, 0, len(apiConf))
+	for name := range apiConf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func encodeToolsCursor(lastName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastName))
+}
+
+func decodeToolsCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(b), err
+}
+
+// mcpContentTypes はスクリプトから返せる MCP コンテンツの種類です。
+var mcpContentTypes = map[string]bool{
+	"text":          true,
+	"image":         true,
+	"audio":         true,
+	"resource":      true,
+	"resource_link": true,
+}
+
+// buildToolCallResult はスクリプトの出力を tools/call の結果に整形します。
+//   - JSON オブジェクトなら structuredContent にも入れる
+//   - success=false または status>=400 なら isError=true
+//   - mcpContent 配列があれば image / resource などのコンテンツとして追加する
+func buildToolCallResult(out string) map[string]any {
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(out)), &obj); err != nil || obj == nil {
+		// JSON オブジェクトでなければ従来どおり text のみ
+		return map[string]any{
+			"content": []map[string]any{{"type": "text", "text": stringOrJSON(out)}},
+			"isError": false,
+		}
+	}
+
+	extra := []map[string]any{}
+	if raw, ok := obj["mcpContent"]; ok {
+		delete(obj, "mcpContent")
+		if items, ok := raw.([]any); ok {
+			for _, v := range items {
+				item, ok := v.(map[string]any)
+				if !ok {
+					continue
+				}
+				if t, _ := item["type"].(string); !mcpContentTypes[t] {
+					logger.Printf("MCP: ignoring unsupported content type %v", item["type"])
+					continue
+				}
+				extra = append(extra, item)
+			}
+		}
+	}
+
+	isError := false
+	if success, ok := obj["success"].(bool); ok && !success {
+		isError = true
+	}
+	if status, ok := obj["status"].(float64); ok && status >= 400 {
+		isError = true
+	}
+
+	text, _ := json.MarshalIndent(obj, "", "  ")
+	content := append([]map[string]any{{"type": "text", "text": string(text)}}, extra...)
+	return map[string]any{
+		"content":           content,
+		"structuredContent": obj,
+		"isError":           isError,
+	}
+}
+
+// toolErrorJSON は callJS が返すエラー応答（スクリプトの失敗応答と同じ形）を作ります。
+func toolErrorJSON(status int, message string) string {
+	js, _ := json.Marshal(map[string]any{"success": false, "status": status, "error": message})
+	return string(js)
+}
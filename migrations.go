@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MigrationsConfig はデータベースのマイグレーションの設定です（config.json の migrations）。
+type MigrationsConfig struct {
+	Dir      string `json:"dir"`      // SQL ファイルのディレクトリ。既定 ./migrations
+	Database string `json:"database"` // databases の接続名。接続が 1 つなら省略可
+	Table    string `json:"table"`    // 適用済みのバージョンを記録するテーブル。既定 schema_migrations
+	Auto     bool   `json:"auto"`     // サーバー起動時に未適用のマイグレーションを適用する
+}
+
+// migration は 1 つのバージョンの SQL ファイルです。
+type migration struct {
+	Version int64
+	Label   string // ファイル名の "0001_create_users" の部分
+	Name    string
+	Up      string // ファイルのパス
+	Down    string // 無ければ空（down できない）
+}
+
+// appliedMigration は記録テーブルの 1 行です。
+type appliedMigration struct {
+	Name      string
+	AppliedAt string
+}
+
+// 0001_create_users.up.sql / 0001_create_users.down.sql / 0001_create_users.sql（up のみ）
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+?)(?:\.(up|down))?\.sql$`)
+
+var sqlIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// migrator は設定から決まるマイグレーションの対象です。
+type migrator struct {
+	dbName string
+	db     *sqlDatabase
+	dir    string
+	table  string
+}
+
+func newMigrator(execDir string) (*migrator, error) {
+	mc := globalConfig.Migrations
+	name, db, err := lookupDatabase(mc.Database)
+	if err != nil {
+		return nil, fmt.Errorf("migrations.database: %w", err)
+	}
+	d := mc.Dir
+	if d == "" {
+		d = "./migrations"
+	}
+	dir, err := resolvePath(execDir, d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid migrations.dir: %w", err)
+	}
+	table := mc.Table
+	if table == "" {
+		table = "schema_migrations"
+	}
+	if !sqlIdentifierPattern.MatchString(table) {
+		return nil, fmt.Errorf("invalid migrations.table %q", table)
+	}
+	return &migrator{dbName: name, db: db, dir: dir, table: table}, nil
+}
+
+// load はディレクトリの SQL ファイルをバージョン順に読み込みます。
+func (m *migrator) load() ([]migration, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*migration{}
+	for _, e := range entries {
+		match := migrationFilePattern.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		mg, ok := byVersion[version]
+		if !ok {
+			mg = &migration{Version: version, Label: match[1] + "_" + match[2], Name: match[2]}
+			byVersion[version] = mg
+		} else if mg.Name != match[2] {
+			return nil, fmt.Errorf("duplicate migration version %d (%s, %s)", version, mg.Name, match[2])
+		}
+		path := filepath.Join(m.dir, e.Name())
+		if match[3] == "down" {
+			mg.Down = path
+		} else if mg.Up != "" {
+			return nil, fmt.Errorf("duplicate up migration for version %d", version)
+		} else {
+			mg.Up = path
+		}
+	}
+	list := make([]migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, fmt.Errorf("migration %s has no up file", mg.Label)
+		}
+		list = append(list, *mg)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// placeholder は n 番目のパラメータの書き方を返します（PostgreSQL は $1、それ以外は ?）。
+func (m *migrator) placeholder(n int) string {
+	if m.db.driver == "pgx" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// applied は記録テーブルを（無ければ作ってから）読み込みます。
+func (m *migrator) applied(ctx context.Context) (map[int64]appliedMigration, error) {
+	_, err := m.db.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.table+
+		" (version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at VARCHAR(40) NOT NULL)")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := m.db.db.QueryContext(ctx, "SELECT version, name, applied_at FROM "+m.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var v int64
+		var a appliedMigration
+		if err := rows.Scan(&v, &a.Name, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
+
+// run は SQL ファイルと記録の更新を 1 つのトランザクションで実行します。
+// MySQL の DDL は暗黙にコミットされるため、途中で失敗した場合は手動で戻す必要があります。
+func (m *migrator) run(ctx context.Context, path string, record func(tx *sql.Tx) error) error {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tx, err := m.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// up は未適用のマイグレーションを古い順に最大 steps 個（0 なら全て）適用し、適用した数を返します。
+func (m *migrator) up(ctx context.Context, steps int) (int, error) {
+	list, err := m.load()
+	if err != nil {
+		return 0, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (%s, %s, %s)",
+		m.table, m.placeholder(1), m.placeholder(2), m.placeholder(3))
+	n := 0
+	for _, mg := range list {
+		if _, ok := applied[mg.Version]; ok {
+			continue
+		}
+		if steps > 0 && n >= steps {
+			break
+		}
+		err := m.run(ctx, mg.Up, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, insert, mg.Version, mg.Name, time.Now().UTC().Format(time.RFC3339))
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("migration %s failed: %w", mg.Label, err)
+		}
+		logger.Printf("Migrate: applied %s", mg.Label)
+		n++
+	}
+	return n, nil
+}
+
+// down は適用済みのマイグレーションを新しい順に steps 個戻し、戻した数を返します。
+func (m *migrator) down(ctx context.Context, steps int) (int, error) {
+	list, err := m.load()
+	if err != nil {
+		return 0, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	del := fmt.Sprintf("DELETE FROM %s WHERE version = %s", m.table, m.placeholder(1))
+	n := 0
+	for i := len(list) - 1; i >= 0 && n < steps; i-- {
+		mg := list[i]
+		if _, ok := applied[mg.Version]; !ok {
+			continue
+		}
+		if mg.Down == "" {
+			return n, fmt.Errorf("migration %s has no down file", mg.Label)
+		}
+		err := m.run(ctx, mg.Down, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, del, mg.Version)
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("rollback of %s failed: %w", mg.Label, err)
+		}
+		logger.Printf("Migrate: rolled back %s", mg.Label)
+		n++
+	}
+	return n, nil
+}
+
+// status は各マイグレーションの適用状況を表示します。
+func (m *migrator) status(ctx context.Context) error {
+	list, err := m.load()
+	if err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database: %s  Directory: %s\n", m.dbName, m.dir)
+	known := map[int64]bool{}
+	for _, mg := range list {
+		known[mg.Version] = true
+		if a, ok := applied[mg.Version]; ok {
+			fmt.Printf("  applied  %s  (%s)\n", mg.Label, a.AppliedAt)
+		} else {
+			fmt.Printf("  pending  %s\n", mg.Label)
+		}
+	}
+	// 記録はあるがファイルが無いもの（別のブランチで適用した場合など）
+	for v, a := range applied {
+		if !known[v] {
+			fmt.Printf("  missing  %d_%s  (%s)\n", v, a.Name, a.AppliedAt)
+		}
+	}
+	return nil
+}
+
+// runMigrateCommand は nyan8 migrate up [N] | down [N] | status を実行します。
+func runMigrateCommand(execDir string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: nyan8 migrate up [N] | down [N] | status")
+	}
+	steps := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number of steps: %s", args[1])
+		}
+		steps = n
+	}
+	m, err := newMigrator(execDir)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		n, err := m.up(ctx, steps)
+		fmt.Printf("Applied %d migration(s)\n", n)
+		return err
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		n, err := m.down(ctx, steps)
+		fmt.Printf("Rolled back %d migration(s)\n", n)
+		return err
+	case "status":
+		return m.status(ctx)
+	}
+	return fmt.Errorf("unknown migrate command %q (up, down, status)", args[0])
+}
+
+// autoMigrate は migrations.auto が有効なら未適用のマイグレーションを適用します。
+func autoMigrate(execDir string) error {
+	if !globalConfig.Migrations.Auto {
+		return nil
+	}
+	m, err := newMigrator(execDir)
+	if err != nil {
+		return err
+	}
+	n, err := m.up(context.Background(), 0)
+	if n > 0 {
+		logger.Printf("Migrate: applied %d pending migration(s) at startup", n)
+	}
+	return err
+}
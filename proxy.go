@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// 既定で参照するクライアント IP のヘッダー（上から順に試す）
+var defaultClientIPHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"}
+
+var (
+	trustedProxyNets   []*net.IPNet
+	trustedProxyNetsMu sync.RWMutex
+)
+
+// initTrustedProxies は config.json の trusted_proxies（IP または CIDR）を読み込みます。
+func initTrustedProxies() error {
+	nets, err := parseCIDRList(globalConfig.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	trustedProxyNetsMu.Lock()
+	trustedProxyNets = nets
+	trustedProxyNetsMu.Unlock()
+	return nil
+}
+
+// parseCIDRList は IP アドレスまたは CIDR の一覧を解析します。
+func parseCIDRList(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxyNetsMu.RLock()
+	defer trustedProxyNetsMu.RUnlock()
+	return ipInNets(ip, trustedProxyNets)
+}
+
+// fromTrustedProxy は直接の接続元が trusted_proxies に含まれるかを返します。
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		host = strings.TrimSpace(r.RemoteAddr)
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isTrustedProxy(ip)
+}
+
+// getClientIP はクライアントの IP アドレスを返します。
+// 直接の接続元が trusted_proxies に含まれる場合に限り、プロキシのヘッダーを参照します。
+// ヘッダーは右（自分に近い側）から評価し、信頼できるプロキシを飛ばした最初のアドレスを採用します。
+func getClientIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	// RemoteAddr のパース（host:port）
+	remote := strings.TrimSpace(r.RemoteAddr)
+	if host, _, err := net.SplitHostPort(remote); err == nil && host != "" {
+		remote = host
+	}
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !isTrustedProxy(remoteIP) {
+		return remote
+	}
+
+	headers := globalConfig.ClientIPHeaders
+	if len(headers) == 0 {
+		headers = defaultClientIPHeaders
+	}
+	for _, name := range headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		var hops []string
+		switch strings.ToLower(name) {
+		case "forwarded":
+			hops = parseForwardedFor(values)
+		case "x-real-ip":
+			hops = []string{strings.TrimSpace(values[len(values)-1])}
+		default:
+			for _, v := range values {
+				for _, p := range strings.Split(v, ",") {
+					hops = append(hops, strings.TrimSpace(p))
+				}
+			}
+		}
+		if ip, ok := clientFromHops(hops, remote); ok {
+			return ip
+		}
+	}
+	return remote
+}
+
+// clientFromHops は経由したアドレスの一覧を右から評価してクライアントを決めます。
+// 解析できないアドレス（unknown や難読化された識別子）に当たった場合は、その手前のプロキシを返します。
+func clientFromHops(hops []string, remote string) (string, bool) {
+	if len(hops) == 0 {
+		return "", false
+	}
+	last := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(stripPort(hops[i]))
+		if ip == nil {
+			return last, true
+		}
+		last = ip.String()
+		if !isTrustedProxy(ip) {
+			return last, true
+		}
+	}
+	// 全て信頼できるプロキシなら最も左のアドレス
+	return last, true
+}
+
+// parseForwardedFor は RFC 7239 の Forwarded ヘッダーから for= の値を順に取り出します。
+func parseForwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			for _, pair := range splitQuoted(elem, ';') {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(k), "for") {
+					hops = append(hops, strings.Trim(strings.TrimSpace(val), `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// splitQuoted は引用符の外にある区切り文字で分割します。
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	inQuote := false
+	start := 0
+	for i, ch := range s {
+		switch {
+		case ch == '"':
+			inQuote = !inQuote
+		case ch == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// stripPort は "1.2.3.4:80" / "[2001:db8::1]:80" / "[2001:db8::1]" からアドレス部分を取り出します。
+func stripPort(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitConfig はレート制限の設定です（config.json の rate_limit）。
+type RateLimitConfig struct {
+	Default   *APIRateLimit `json:"default"`    // api.json で rate_limit 未指定の API に適用
+	Store     string        `json:"store"`      // memory（既定）/ redis
+	RedisURL  string        `json:"redis_url"`  // store=redis の接続先（環境変数展開可）
+	KeyPrefix string        `json:"key_prefix"` // redis のキー接頭辞。既定 nyan8:rl:
+	// 認証に失敗できる回数（IP ごと、全 API 共通）。未指定なら 5 分あたり 10 回、requests が 0 なら制限しない
+	AuthFailures *APIRateLimit `json:"auth_failures"`
+}
+
+// APIRateLimit は API ごとのトークンバケットです（api.json の rate_limit）。
+// window 秒あたり requests 回まで、瞬間的には burst 回まで許可します。
+type APIRateLimit struct {
+	Requests int    `json:"requests"`
+	Window   int    `json:"window"` // 秒。0 なら 60
+	Burst    int    `json:"burst"`  // 0 なら requests と同じ
+	Key      string `json:"key"`    // ip（既定）/ apikey / principal
+}
+
+// APIConcurrency は API ごとの同時実行数の上限です（api.json の concurrency）。
+type APIConcurrency struct {
+	Max          int    `json:"max"`
+	OnLimit      string `json:"on_limit"`      // queue（既定）/ reject
+	QueueTimeout int    `json:"queue_timeout"` // 待ち時間の上限（秒）。0 なら 30
+}
+
+// rateLimitResult は 1 回の消費の結果です。
+type rateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // 次の 1 回が許可されるまで
+	Reset      time.Duration // バケットが満杯に戻るまで
+}
+
+// rateLimitStore はトークンバケットの保存先です。
+// take は cost 個のトークンを消費します。cost が 0 なら消費せずに残りがあるかだけを確認します。
+type rateLimitStore interface {
+	take(ctx context.Context, key string, rate float64, burst, cost int) (rateLimitResult, error)
+}
+
+var (
+	rateLimiter   rateLimitStore = newMemoryRateLimitStore()
+	apiSemaphores sync.Map       // "API名:上限" -> chan struct{}
+)
+
+// initRateLimit はレート制限の保存先を準備します。
+func initRateLimit() error {
+	rl := globalConfig.RateLimit
+	switch rl.Store {
+	case "", "memory":
+		go rateLimiter.(*memoryRateLimitStore).janitor(time.Minute)
+		return nil
+	case "redis":
+		opts, err := redis.ParseURL(os.ExpandEnv(rl.RedisURL))
+		if err != nil {
+			return fmt.Errorf("invalid rate_limit.redis_url: %w", err)
+		}
+		prefix := rl.KeyPrefix
+		if prefix == "" {
+			prefix = "nyan8:rl:"
+		}
+		rateLimiter = &redisRateLimitStore{client: redis.NewClient(opts), prefix: prefix}
+		return nil
+	}
+	return fmt.Errorf("unknown rate_limit.store %q", rl.Store)
+}
+
+// apiRateLimit は api.json の rate_limit（無ければ config.json の rate_limit.default）を返します。
+// "rate_limit": false で既定の制限を外せます。
+func apiRateLimit(apiInfo map[string]any) *APIRateLimit {
+	raw, ok := apiInfo["rate_limit"]
+	if !ok {
+		return globalConfig.RateLimit.Default
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return nil
+	}
+	js, _ := json.Marshal(m)
+	var rl APIRateLimit
+	if err := json.Unmarshal(js, &rl); err != nil {
+		logger.Printf("Invalid rate_limit setting in api.json: %v", err)
+		return nil
+	}
+	return &rl
+}
+
+// checkRateLimit はレート制限を 1 回分消費し、RateLimit-* ヘッダーを設定します。
+func checkRateLimit(c *gin.Context, apiName string, apiInfo map[string]any) *apiGuardError {
+	rl := apiRateLimit(apiInfo)
+	if rl == nil || rl.Requests <= 0 {
+		return nil
+	}
+	window := ttlSeconds(rl.Window, 60)
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = rl.Requests
+	}
+	rate := float64(rl.Requests) / window.Seconds()
+
+	key := apiName + "|" + rateLimitClientKey(c, rl.Key)
+	res, err := rateLimiter.take(c.Request.Context(), key, rate, burst, 1)
+	if err != nil {
+		// 保存先の障害で API 全体を止めないよう、制限せずに通す
+		logger.Printf("RateLimit: store error for %s: %v", apiName, err)
+		return nil
+	}
+
+	headers := map[string]string{
+		"RateLimit-Limit":     strconv.Itoa(burst),
+		"RateLimit-Remaining": strconv.Itoa(res.Remaining),
+		"RateLimit-Reset":     strconv.Itoa(ceilSeconds(res.Reset)),
+		"RateLimit-Policy":    fmt.Sprintf("%d;w=%d;burst=%d", rl.Requests, int(window.Seconds()), burst),
+	}
+	if !res.Allowed {
+		headers["Retry-After"] = strconv.Itoa(ceilSeconds(res.RetryAfter))
+		return &apiGuardError{Status: http.StatusTooManyRequests, Message: "Rate limit exceeded", Headers: headers}
+	}
+	for k, v := range headers {
+		c.Header(k, v)
+	}
+	return nil
+}
+
+// 認証失敗の既定の上限
+var defaultAuthFailureLimit = APIRateLimit{Requests: 10, Window: 300}
+
+// authFailureBucket は認証失敗を数えるバケットのキーと設定を返します（制限しない場合は ok = false）。
+// username を指定すると IP とユーザー名の組で数えます（OAuth の同意画面のログイン）。
+func authFailureBucket(c *gin.Context, username string) (key string, rate float64, burst int, ok bool) {
+	rl := globalConfig.RateLimit.AuthFailures
+	if rl == nil {
+		rl = &defaultAuthFailureLimit
+	}
+	if rl.Requests <= 0 {
+		return "", 0, 0, false
+	}
+	burst = rl.Burst
+	if burst <= 0 {
+		burst = rl.Requests
+	}
+	rate = float64(rl.Requests) / ttlSeconds(rl.Window, 60).Seconds()
+	key = "authfail|ip:" + getClientIP(c.Request)
+	if username != "" {
+		key += "|user:" + username
+	}
+	return key, rate, burst, true
+}
+
+// checkAuthFailures は呼び出し元の IP が認証に失敗しすぎていないかを確認します（数えない）。
+// 上限に達している間は資格情報を検証せずに 429 を返し、総当たりで正解を判別できないようにします。
+func checkAuthFailures(c *gin.Context, username string) *apiGuardError {
+	key, rate, burst, ok := authFailureBucket(c, username)
+	if !ok {
+		return nil
+	}
+	res, err := rateLimiter.take(c.Request.Context(), key, rate, burst, 0)
+	if err != nil {
+		logger.Printf("RateLimit: store error for auth failures: %v", err)
+		return nil
+	}
+	if res.Allowed {
+		return nil
+	}
+	return &apiGuardError{
+		Status:  http.StatusTooManyRequests,
+		Message: "Too many failed authentication attempts",
+		Headers: map[string]string{"Retry-After": strconv.Itoa(ceilSeconds(res.RetryAfter))},
+	}
+}
+
+// recordAuthFailure は認証の失敗を 1 回数えます。
+func recordAuthFailure(c *gin.Context, username string) {
+	key, rate, burst, ok := authFailureBucket(c, username)
+	if !ok {
+		return
+	}
+	if _, err := rateLimiter.take(c.Request.Context(), key, rate, burst, 1); err != nil {
+		logger.Printf("RateLimit: store error for auth failures: %v", err)
+	}
+}
+
+// rateLimitClientKey は制限の単位となる呼び出し元のキーを返します。
+// apikey / principal で呼び出し元が特定できない場合は IP アドレスを使います。
+func rateLimitClientKey(c *gin.Context, keyType string) string {
+	p := principalFromContext(c)
+	switch keyType {
+	case "apikey":
+		if p != nil && p.Method == "apikey" {
+			return "apikey:" + p.Subject
+		}
+	case "principal":
+		if p != nil {
+			return "principal:" + p.Method + ":" + p.Subject
+		}
+	}
+	return "ip:" + getClientIP(c.Request)
+}
+
+// acquireAPISlot は API の同時実行枠を確保し、解放用の関数を返します。
+// 上限に達している場合は on_limit に従って待つか、すぐに 503 を返します。
+func acquireAPISlot(c *gin.Context, apiName string, apiInfo map[string]any) (func(), *apiGuardError) {
+	raw, ok := apiInfo["concurrency"].(map[string]any)
+	if !ok {
+		return func() {}, nil
+	}
+	js, _ := json.Marshal(raw)
+	var cc APIConcurrency
+	if err := json.Unmarshal(js, &cc); err != nil || cc.Max <= 0 {
+		return func() {}, nil
+	}
+
+	// api.json は実行中にも書き換えられるので、上限値ごとに枠を分ける
+	v, _ := apiSemaphores.LoadOrStore(fmt.Sprintf("%s:%d", apiName, cc.Max), make(chan struct{}, cc.Max))
+	sem := v.(chan struct{})
+	release := func() { <-sem }
+
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+	busy := &apiGuardError{
+		Status:  http.StatusServiceUnavailable,
+		Message: "Too many concurrent executions",
+		Headers: map[string]string{"Retry-After": "1"},
+	}
+	if cc.OnLimit == "reject" {
+		return nil, busy
+	}
+
+	ctx := context.Background()
+	if c != nil {
+		ctx = c.Request.Context()
+	}
+	timer := time.NewTimer(ttlSeconds(cc.QueueTimeout, 30))
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, busy
+	case <-ctx.Done():
+		return nil, busy
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// memoryRateLimitStore はプロセス内のトークンバケットです。
+type memoryRateLimitStore struct {
+	buckets sync.Map // key -> *tokenBucket
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	full   time.Time // このときまでに満杯に戻る
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{}
+}
+
+func (s *memoryRateLimitStore) take(_ context.Context, key string, rate float64, burst, cost int) (rateLimitResult, error) {
+	now := time.Now()
+	v, _ := s.buckets.LoadOrStore(key, &tokenBucket{tokens: float64(burst), last: now})
+	b := v.(*tokenBucket)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	res := rateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens -= float64(cost)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	b.full = now.Add(res.Reset)
+	return res, nil
+}
+
+// janitor は満杯に戻ったバケットを定期的に破棄します。
+func (s *memoryRateLimitStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.buckets.Range(func(k, v any) bool {
+			b := v.(*tokenBucket)
+			b.mu.Lock()
+			expired := now.After(b.full)
+			b.mu.Unlock()
+			if expired {
+				s.buckets.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+// redisRateLimitStore は複数インスタンスで共有するトークンバケットです。
+type redisRateLimitStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// redisTokenBucket はバケットの更新を Redis 上で原子的に行います。
+// 戻り値は {許可 0/1, 残りトークン(x1000), 次の許可までの ms, 満杯までの ms}。
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+  tokens = tokens - cost
+  allowed = 1
+else
+  retry = math.ceil((1 - tokens) / rate * 1000)
+end
+local reset = math.ceil((burst - tokens) / rate * 1000)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now)
+redis.call('PEXPIRE', KEYS[1], math.max(reset, 1000))
+return {allowed, math.floor(tokens * 1000), retry, reset}
+`)
+
+func (s *redisRateLimitStore) take(ctx context.Context, key string, rate float64, burst, cost int) (rateLimitResult, error) {
+	vals, err := redisTokenBucket.Run(ctx, s.client, []string{s.prefix + key}, rate, burst, cost).Int64Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	if len(vals) != 4 {
+		return rateLimitResult{}, fmt.Errorf("unexpected script result %v", vals)
+	}
+	return rateLimitResult{
+		Allowed:    vals[0] == 1,
+		Remaining:  int(vals[1] / 1000),
+		RetryAfter: time.Duration(vals[2]) * time.Millisecond,
+		Reset:      time.Duration(vals[3]) * time.Millisecond,
+	}, nil
+}
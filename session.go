@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// SessionConfig はスクリプトから使うセッション（nyanSession）の設定です（config.json の session）。
+type SessionConfig struct {
+	CookieName string `json:"cookie_name"` // 既定 nyan8_sid
+	MaxAge     int    `json:"max_age"`     // 有効期間（秒）。最後に書き込んでからの時間。既定 86400
+	SameSite   string `json:"same_site"`   // lax（既定）/ strict / none
+	Secure     *bool  `json:"secure"`      // 既定は HTTPS で受けたリクエストなら true
+	Path       string `json:"path"`        // 既定 /
+	Domain     string `json:"domain"`
+	Secret     string `json:"secret"`      // Cookie の署名鍵（環境変数展開可）。未設定なら secret_file に生成
+	SecretFile string `json:"secret_file"` // 既定 session.key
+}
+
+// セッションのデータは storage の "session" 名前空間に保存します
+var webSessionStore = newKVNamespace("session")
+
+var webSessionKey []byte
+
+// initWebSessions はセッション Cookie の署名鍵を用意します。
+// secret が無い場合は鍵ファイルを作り、再起動後も同じ鍵で検証できるようにします。
+func initWebSessions(execDir string) error {
+	sc := globalConfig.Session
+	if secret := os.ExpandEnv(sc.Secret); secret != "" {
+		webSessionKey = []byte(secret)
+		return nil
+	}
+	name := sc.SecretFile
+	if name == "" {
+		name = "session.key"
+	}
+	path, err := resolvePath(execDir, name)
+	if err != nil {
+		return fmt.Errorf("invalid session.secret_file: %w", err)
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) < 32 {
+			return fmt.Errorf("invalid session key in %s", path)
+		}
+		webSessionKey = key
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to save session key: %w", err)
+	}
+	logger.Printf("Session: generated a new signing key in %s", filepath.Base(path))
+	webSessionKey = key
+	return nil
+}
+
+func webSessionCookieName() string {
+	if n := globalConfig.Session.CookieName; n != "" {
+		return n
+	}
+	return "nyan8_sid"
+}
+
+func webSessionMaxAge() time.Duration {
+	return ttlSeconds(globalConfig.Session.MaxAge, 86400)
+}
+
+// signSessionID は "ID.署名" 形式の Cookie の値を作ります。
+func signSessionID(id string) string {
+	mac := hmac.New(sha256.New, webSessionKey)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySessionCookie は署名を検証し、セッション ID を返します。
+func verifySessionCookie(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(signSessionID(id)), []byte(value)) != 1 {
+		return "", false
+	}
+	return id, true
+}
+
+// parseSameSite は same_site の文字列を http.SameSite にします。
+func parseSameSite(s string) http.SameSite {
+	switch strings.ToLower(s) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	case "lax", "":
+		return http.SameSiteLaxMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+// sessionCookie はセッション Cookie を作ります（maxAge が負なら削除用）。
+func sessionCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	sc := globalConfig.Session
+	path := sc.Path
+	if path == "" {
+		path = "/"
+	}
+	ck := &http.Cookie{
+		Name:     webSessionCookieName(),
+		Value:    value,
+		Path:     path,
+		Domain:   sc.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: parseSameSite(sc.SameSite),
+		Secure:   r != nil && r.TLS != nil,
+	}
+	if sc.Secure != nil {
+		ck.Secure = *sc.Secure
+	}
+	if ck.SameSite == http.SameSiteNoneMode {
+		// SameSite=None はブラウザが Secure を必須にしている
+		ck.Secure = true
+	}
+	return ck
+}
+
+// webSession は 1 回のスクリプト実行から見たセッションです。
+// WebSocket のメッセージ処理では Cookie を書けないため、既存のセッションの読み書きだけができます。
+type webSession struct {
+	vm *goja.Runtime
+	sr *scriptRequest
+	id string // 無ければ空
+}
+
+func newWebSession(vm *goja.Runtime, sr *scriptRequest) *webSession {
+	return &webSession{vm: vm, sr: sr, id: webSessionIDFromRequest(sr.Request)}
+}
+
+// webSessionIDFromRequest は署名を検証したセッション ID を返します（無ければ空）。
+func webSessionIDFromRequest(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	ck, err := r.Cookie(webSessionCookieName())
+	if err != nil {
+		return ""
+	}
+	id, _ := verifySessionCookie(ck.Value)
+	return id
+}
+
+func (s *webSession) throw(err error) {
+	panic(s.vm.NewGoError(fmt.Errorf("nyanSession: %w", err)))
+}
+
+// load はセッションのデータを返します（無い・期限切れなら nil）。
+func (s *webSession) load() map[string]any {
+	if s.id == "" {
+		return nil
+	}
+	e, err := storage.get(webSessionStore.key(s.id))
+	if err != nil {
+		s.throw(err)
+	}
+	if e == nil {
+		return nil
+	}
+	data := map[string]any{}
+	if err := json.Unmarshal(e.Value, &data); err != nil {
+		return nil
+	}
+	return data
+}
+
+// setCookie はセッション Cookie を応答に付けます。
+func (s *webSession) setCookie(value string, maxAge int) {
+	if s.sr.Gin == nil {
+		s.throw(fmt.Errorf("cannot set the session cookie here (WebSocket messages can only use an existing session)"))
+	}
+	// 同じ実行の中で set / regenerate を繰り返しても Set-Cookie は最後の 1 つだけにする
+	setResponseCookie(s.sr.Gin.Writer, sessionCookie(s.sr.Request, value, maxAge))
+}
+
+// modify はデータを読み取り→変更→保存し、期限を延ばします。セッションが無ければ作ります。
+func (s *webSession) modify(fn func(data map[string]any)) {
+	if s.id == "" {
+		id := generateSecureSessionID()
+		s.setCookie(signSessionID(id), int(webSessionMaxAge().Seconds()))
+		s.id = id
+	} else if s.sr.Gin != nil {
+		// 期限を延ばしたことをブラウザにも伝える
+		s.setCookie(signSessionID(s.id), int(webSessionMaxAge().Seconds()))
+	}
+	err := storage.update(webSessionStore.key(s.id), func(cur *kvEntry) (*kvEntry, bool, error) {
+		data := map[string]any{}
+		if cur != nil {
+			json.Unmarshal(cur.Value, &data)
+		}
+		fn(data)
+		js, err := json.Marshal(data)
+		if err != nil {
+			return nil, false, err
+		}
+		return &kvEntry{Value: js, ExpiresAt: time.Now().Add(webSessionMaxAge())}, true, nil
+	})
+	if err != nil {
+		s.throw(err)
+	}
+}
+
+func (s *webSession) object() *goja.Object {
+	obj := s.vm.NewObject()
+	// id() はセッション ID（無ければ null）を返します
+	obj.Set("id", func() goja.Value {
+		if s.load() == nil {
+			return goja.Null()
+		}
+		return s.vm.ToValue(s.id)
+	})
+	// get(key) は値、get() はデータ全体を返します（無ければ null）
+	obj.Set("get", func(call goja.FunctionCall) goja.Value {
+		data := s.load()
+		if data == nil {
+			return goja.Null()
+		}
+		if key := call.Argument(0); !isNullish(key) {
+			v, ok := data[key.String()]
+			if !ok {
+				return goja.Null()
+			}
+			return s.vm.ToValue(v)
+		}
+		return s.vm.ToValue(data)
+	})
+	// set(key, value) は値を保存します（null なら削除）。セッションが無ければ作ります
+	obj.Set("set", func(key string, value goja.Value) {
+		var v any
+		if !isNullish(value) {
+			v = value.Export()
+		}
+		s.modify(func(data map[string]any) {
+			if v == nil {
+				delete(data, key)
+			} else {
+				data[key] = v
+			}
+		})
+	})
+	// destroy() はセッションを削除し、Cookie も消します
+	obj.Set("destroy", func() {
+		if s.id == "" {
+			return
+		}
+		err := storage.update(webSessionStore.key(s.id), func(*kvEntry) (*kvEntry, bool, error) {
+			return nil, true, nil
+		})
+		if err != nil {
+			s.throw(err)
+		}
+		s.id = ""
+		if s.sr.Gin != nil {
+			s.setCookie("", -1)
+		}
+	})
+	// regenerate() はデータを引き継いで ID を新しくします（ログイン直後のセッション固定攻撃対策）
+	obj.Set("regenerate", func() {
+		// 新しい ID の Cookie を返せない場合は、古いセッションを消す前に失敗させる
+		if s.sr.Gin == nil {
+			s.throw(fmt.Errorf("regenerate: cannot set the session cookie here (WebSocket messages can only use an existing session)"))
+		}
+		data := s.load()
+		if s.id != "" {
+			storage.update(webSessionStore.key(s.id), func(*kvEntry) (*kvEntry, bool, error) {
+				return nil, true, nil
+			})
+		}
+		s.id = ""
+		s.modify(func(m map[string]any) {
+			for k, v := range data {
+				m[k] = v
+			}
+		})
+	})
+	return obj
+}
+
+// setupSessionBindings は nyanSession と、同じセッションを使う nyanCsrfToken を登録します。
+func setupSessionBindings(vm *goja.Runtime, sr *scriptRequest) {
+	s := newWebSession(vm, sr)
+	vm.Set("nyanSession", s.object())
+	setupCSRFBindings(vm, sr, s)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/gorilla/websocket"
+)
+
+// 終了したプロセスを nyanGetProcess で参照できる期間
+const spawnRetention = 10 * time.Minute
+
+// exec.max_processes の既定値
+const defaultSpawnMaxProcesses = 32
+
+// exec.spawn_max_wait_ms の既定値
+const defaultSpawnMaxWait = 30 * time.Second
+
+// 1 行として扱う長さの上限。改行の無い出力はこの長さで区切る
+const spawnMaxLineBytes = 64 << 10
+
+// spawnedProcess は nyanSpawn で起動したプロセスです。
+// スクリプトの実行が終わっても動き続け、別のリクエストから nyanGetProcess で参照できます。
+type spawnedProcess struct {
+	pid    int
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	push   string // 出力を 1 行ずつ送る push 先（api.json の API 名）
+	limit  int
+	target string // 起動時に exec 機能で確認した対象（コマンド名または絶対パス）
+
+	mu        sync.Mutex
+	stdout    strings.Builder // 未読の出力
+	stderr    strings.Builder
+	truncated bool
+	exited    bool
+	exitCode  int
+	timedOut  bool
+	killed    bool
+	exitedAt  time.Time
+	done      chan struct{}
+}
+
+var (
+	spawnedProcesses sync.Map // pid -> *spawnedProcess
+	spawnJanitorOnce sync.Once
+	spawnMu          sync.Mutex // 上限の確認と登録をまとめて行う
+)
+
+func spawnMaxProcesses() int {
+	if n := globalConfig.Exec.MaxProcesses; n > 0 {
+		return n
+	}
+	return defaultSpawnMaxProcesses
+}
+
+// reserveSpawnSlot は記録の数が上限未満か確認します。
+// 上限に達している場合は終了済みのプロセスの記録を保持期間の前でも破棄し、それでも空かなければエラーにします。
+// spawnMu を持った状態で呼び出します。
+func reserveSpawnSlot() error {
+	max := spawnMaxProcesses()
+	count := 0
+	var exited []any
+	spawnedProcesses.Range(func(k, v any) bool {
+		count++
+		p := v.(*spawnedProcess)
+		p.mu.Lock()
+		if p.exited {
+			exited = append(exited, k)
+		}
+		p.mu.Unlock()
+		return true
+	})
+	if count < max {
+		return nil
+	}
+	if len(exited) == 0 {
+		return fmt.Errorf("too many running processes (exec.max_processes = %d)", max)
+	}
+	for _, k := range exited {
+		spawnedProcesses.Delete(k)
+	}
+	return nil
+}
+
+// spawnProcess はオブジェクト形式の引数でプロセスを起動し、出力の読み取りを始めます。
+func spawnProcess(opts *ExecOptions, push, target string) (*spawnedProcess, error) {
+	spawnMu.Lock()
+	defer spawnMu.Unlock()
+	if err := reserveSpawnSlot(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := execContext(opts.Timeout)
+	cmd := exec.CommandContext(ctx, opts.Path, opts.Args...)
+	cmd.Dir = opts.Dir
+	cmd.Env = execEnv(opts.Env)
+	cmd.WaitDelay = time.Second
+	if opts.Stdin != "" {
+		cmd.Stdin = strings.NewReader(opts.Stdin)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to exec: %w", err)
+	}
+
+	p := &spawnedProcess{
+		pid:    cmd.Process.Pid,
+		cmd:    cmd,
+		cancel: cancel,
+		push:   push,
+		limit:  opts.MaxOutputBytes,
+		target: target,
+		done:   make(chan struct{}),
+	}
+	spawnedProcesses.Store(p.pid, p)
+	spawnJanitorOnce.Do(startSpawnJanitor)
+	logger.Printf("Spawn: started pid %d (%s)", p.pid, opts.Path)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go p.collect(stdout, "stdout", &wg)
+	go p.collect(stderr, "stderr", &wg)
+	go func() {
+		// パイプを読み切ってから Wait する（os/exec の決まり）
+		wg.Wait()
+		err := cmd.Wait()
+		p.finish(ctx, err)
+	}()
+	return p, nil
+}
+
+// scanOutputLines は \n・\r\n・\r（ffmpeg などの進捗表示）で区切る bufio.SplitFunc です。
+// 区切り文字は行に含めたまま返し、区切りの無い長い出力は spawnMaxLineBytes ごとに返します。
+func scanOutputLines(data []byte, atEOF bool) (int, []byte, error) {
+	for i, b := range data {
+		switch b {
+		case '\n':
+			return i + 1, data[:i+1], nil
+		case '\r':
+			if i+1 < len(data) {
+				if data[i+1] == '\n' {
+					return i + 2, data[:i+2], nil
+				}
+				return i + 1, data[:i+1], nil
+			}
+			if atEOF {
+				return i + 1, data[:i+1], nil
+			}
+			return 0, nil, nil // 次が \n か確認するために続きを読む
+		}
+	}
+	if len(data) >= spawnMaxLineBytes {
+		return spawnMaxLineBytes, data[:spawnMaxLineBytes], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// collect は出力を 1 行ずつ未読バッファに溜め、push 先があれば送信します。
+func (p *spawnedProcess) collect(r io.Reader, stream string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), spawnMaxLineBytes+1)
+	sc.Split(scanOutputLines)
+	for sc.Scan() {
+		if line := decodeCommandOutput(sc.Bytes()); line != "" {
+			p.mu.Lock()
+			buf := &p.stdout
+			if stream == "stderr" {
+				buf = &p.stderr
+			}
+			if room := p.limit - buf.Len(); room < len(line) {
+				p.truncated = true
+				if room > 0 {
+					buf.WriteString(line[:room])
+				}
+			} else {
+				buf.WriteString(line)
+			}
+			p.mu.Unlock()
+			p.pushEvent(map[string]any{"stream": stream, "line": strings.TrimRight(line, "\r\n")})
+		}
+	}
+	// 読み取りエラー（通常は起きない）の場合も、子プロセスが書き込みで止まらないよう読み捨てる
+	io.Copy(io.Discard, r)
+}
+
+func (p *spawnedProcess) finish(ctx context.Context, err error) {
+	p.mu.Lock()
+	p.exited = true
+	p.exitedAt = time.Now()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		p.timedOut = true
+		p.exitCode = -1
+	case errors.As(err, &exitErr):
+		p.exitCode = exitErr.ExitCode()
+	case err != nil:
+		p.exitCode = -1
+	}
+	code := p.exitCode
+	p.mu.Unlock()
+	p.cancel()
+	close(p.done)
+	logger.Printf("Spawn: pid %d exited with %d", p.pid, code)
+	p.pushEvent(map[string]any{"event": "exit", "exitCode": code})
+}
+
+// pushEvent は push 先の WebSocket 接続にイベントを送ります。
+func (p *spawnedProcess) pushEvent(ev map[string]any) {
+	if p.push == "" {
+		return
+	}
+	connRaw, ok := pushConnections.Load(p.push)
+	if !ok {
+		return
+	}
+	conn, ok := connRaw.(*websocket.Conn)
+	if !ok {
+		return
+	}
+	ev["type"] = "process"
+	ev["pid"] = p.pid
+	js, _ := json.Marshal(ev)
+	if err := writeWSMessage(conn, websocket.TextMessage, js); err != nil {
+		logger.Printf("Spawn: failed to push output of pid %d to %s: %v", p.pid, p.push, err)
+	}
+}
+
+// status は未読の出力を取り出し、状態と合わせて返します。
+func (p *spawnedProcess) status() map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := map[string]any{
+		"pid":       p.pid,
+		"running":   !p.exited,
+		"stdout":    p.stdout.String(),
+		"stderr":    p.stderr.String(),
+		"truncated": p.truncated,
+		"exitCode":  nil,
+	}
+	p.stdout.Reset()
+	p.stderr.Reset()
+	p.truncated = false
+	if p.exited {
+		st["exitCode"] = p.exitCode
+		st["success"] = p.exitCode == 0 && !p.timedOut && !p.killed
+		st["timedOut"] = p.timedOut
+		st["killed"] = p.killed
+	}
+	return st
+}
+
+func spawnMaxWait() time.Duration {
+	if ms := globalConfig.Exec.SpawnMaxWaitMs; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultSpawnMaxWait
+}
+
+// wait は終了まで待ちます。timeout が 0 以下か exec.spawn_max_wait_ms を超える場合は spawn_max_wait_ms までにし、
+// リクエストが終わった（クライアントが切断した）場合もそこで戻ります。
+// プロセスには既定で時間の上限が無いため、スクリプトとその同時実行枠が止まったままにならないようにします。
+func (p *spawnedProcess) wait(ctx context.Context, timeout time.Duration) {
+	if max := spawnMaxWait(); timeout <= 0 || timeout > max {
+		timeout = max
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func (p *spawnedProcess) kill() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	p.mu.Lock()
+	p.killed = true
+	p.mu.Unlock()
+	return p.cmd.Process.Kill() == nil
+}
+
+// startSpawnJanitor は終了から一定時間経ったプロセスの記録を破棄します。
+func startSpawnJanitor() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			spawnedProcesses.Range(func(k, v any) bool {
+				p := v.(*spawnedProcess)
+				p.mu.Lock()
+				expired := p.exited && now.Sub(p.exitedAt) > spawnRetention
+				p.mu.Unlock()
+				if expired {
+					spawnedProcesses.Delete(k)
+				}
+				return true
+			})
+		}
+	}()
+}
+
+// processHandle は JS に返すプロセスのハンドル（pid / read / wait / kill）を作ります。
+func processHandle(vm *goja.Runtime, sr *scriptRequest, p *spawnedProcess) goja.Value {
+	ctx := context.Background()
+	if sr.Request != nil {
+		ctx = sr.Request.Context()
+	}
+	h := vm.NewObject()
+	h.Set("pid", p.pid)
+	// read は未読の出力と状態を返します（待たない）
+	h.Set("read", func() map[string]any {
+		return p.status()
+	})
+	// wait は終了を待ってから未読の出力と状態を返します。timeoutMs（最大 spawn_max_wait_ms）を過ぎたら running: true のまま返します。
+	h.Set("wait", func(call goja.FunctionCall) goja.Value {
+		ms, _ := toInt(call.Argument(0).Export())
+		p.wait(ctx, time.Duration(ms)*time.Millisecond)
+		return vm.ToValue(p.status())
+	})
+	h.Set("kill", func() bool {
+		return p.kill()
+	})
+	return h
+}
+
+// setupSpawnBindings は nyanSpawn / nyanGetProcess を登録します（exec 機能が必要）。
+func setupSpawnBindings(vm *goja.Runtime, sr *scriptRequest) {
+	setCapabilityBinding(vm, sr, "exec", "nyanSpawn", func(call goja.FunctionCall) goja.Value {
+		obj, ok := call.Argument(0).Export().(map[string]any)
+		if !ok {
+			panic(vm.ToValue("nyanSpawn requires an object argument {cmd, args, ...}"))
+		}
+		opts, err := parseExecOptions(obj)
+		if err != nil {
+			panic(vm.ToValue(err.Error()))
+		}
+		if ms := globalConfig.Exec.SpawnDefaultTimeoutMs; ms > 0 {
+			if _, ok := obj["timeoutMs"]; !ok {
+				// 長時間のジョブ向けに default_timeout_ms とは別の上限を設定できる
+				opts.Timeout = time.Duration(ms) * time.Millisecond
+			}
+		}
+		target := opts.Path
+		if sr.Caps.allows("exec", opts.Cmd) {
+			target = opts.Cmd
+		}
+		sr.Caps.require(vm, sr, "exec", target)
+
+		push, _ := obj["push"].(string)
+		p, err := spawnProcess(opts, push, target)
+		if err != nil {
+			panic(vm.ToValue(err.Error()))
+		}
+		return processHandle(vm, sr, p)
+	})
+
+	setCapabilityBinding(vm, sr, "exec", "nyanGetProcess", func(call goja.FunctionCall) goja.Value {
+		pid, _ := toInt(call.Argument(0).Export())
+		v, ok := spawnedProcesses.Load(pid)
+		if !ok {
+			return goja.Null()
+		}
+		p := v.(*spawnedProcess)
+		// nyanSpawn と同じ対象で確認する（exec:ffmpeg のようにコマンド名で許可した API でも取得できるように）
+		sr.Caps.require(vm, sr, "exec", p.target)
+		return processHandle(vm, sr, p)
+	})
+}